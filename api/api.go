@@ -1,17 +1,24 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hound-search/hound/audit"
+	"github.com/hound-search/hound/auth"
 	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/federation"
 	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/saved"
 	"github.com/hound-search/hound/searcher"
 )
 
@@ -55,6 +62,7 @@ type searchResponse struct {
  * Searches all repos in parallel.
  */
 func searchAll(
+	pool *workerPool,
 	query string,
 	opts *index.SearchOptions,
 	repos []string,
@@ -69,10 +77,11 @@ func searchAll(
 	// use a buffered channel to avoid routine leaks on errs.
 	ch := make(chan *searchResponse, n)
 	for _, repo := range repos {
-		go func(repo string) {
+		repo := repo
+		pool.run(func() {
 			fms, err := idx[repo].Search(query, opts)
 			ch <- &searchResponse{repo, fms, err}
-		}(repo)
+		})
 	}
 
 	res := map[string]*index.SearchResponse{}
@@ -82,7 +91,7 @@ func searchAll(
 			return nil, r.err
 		}
 
-		if r.res.Matches == nil {
+		if r.res.Matches == nil && r.res.Commits == nil {
 			continue
 		}
 
@@ -95,12 +104,150 @@ func searchAll(
 	return res, nil
 }
 
+// Count the other repos that the caller can see with the same content as
+// each matching file. Responses may be shared with the result cache, so
+// the ones with duplicates are copied rather than changed.
+func countDuplicates(results map[string]*index.SearchResponse, visible map[string]*searcher.Searcher) {
+	for repo, res := range results {
+		var matches []*index.FileMatch
+		for i, fm := range res.Matches {
+			if fm.ContentHash == "" {
+				continue
+			}
+
+			n := 0
+			for name, srch := range visible {
+				if name != repo && srch.HasContent(fm.ContentHash) {
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+
+			if matches == nil {
+				matches = append([]*index.FileMatch(nil), res.Matches...)
+			}
+			cp := *fm
+			cp.DuplicateRepos = n
+			matches[i] = &cp
+		}
+
+		if matches != nil {
+			cp := *res
+			cp.Matches = matches
+			results[repo] = &cp
+		}
+	}
+}
+
+// Add who last changed each matching line to the results, blaming the
+// repos in parallel on the pool's workers.
+func blameAll(
+	pool *workerPool,
+	results map[string]*index.SearchResponse,
+	visible map[string]*searcher.Searcher) {
+	blamed := make(map[string]*index.SearchResponse, len(results))
+	var lck sync.Mutex
+	var wg sync.WaitGroup
+	for repo, res := range results {
+		repo, res := repo, res
+		wg.Add(1)
+		pool.run(func() {
+			defer wg.Done()
+			b := visible[repo].Blame(res)
+
+			lck.Lock()
+			defer lck.Unlock()
+			blamed[repo] = b
+		})
+	}
+	wg.Wait()
+
+	for repo, res := range blamed {
+		results[repo] = res
+	}
+}
+
+// A repo as listed by the repos API, along with how much of it is written
+// in each language. Repos from peers have no language stats. Only the
+// public view of a repo is listed.
+type repoInfo struct {
+	*config.Repo
+	Languages map[string]*index.LanguageStats `json:"languages,omitempty"`
+}
+
 // Used for parsing flags from form values.
 func parseAsBool(v string) bool {
 	v = strings.ToLower(v)
 	return v == "true" || v == "1" || v == "fosho"
 }
 
+// Only the repos that the caller of the request is allowed to see. Requests
+// forwarded by a peer never see restricted repos, since the peer passes its
+// results on to callers that it can't check against our access lists.
+func visibleRepos(r *http.Request, idx map[string]*searcher.Searcher) map[string]*searcher.Searcher {
+	id := auth.IdentityFrom(r)
+	forwarded := parseAsBool(r.FormValue("local"))
+	res := map[string]*searcher.Searcher{}
+	for name, srch := range idx {
+		if forwarded && srch.Repo.IsRestricted() {
+			continue
+		}
+
+		if id.CanAccess(srch.Repo) {
+			res[name] = srch
+		}
+	}
+	return res
+}
+
+// Record a search in the audit log.
+func logSearch(
+	a *audit.Logger,
+	r *http.Request,
+	query string,
+	repos []string,
+	opt *index.SearchOptions,
+	results map[string]*index.SearchResponse,
+	filesOpened int,
+	startedAt time.Time,
+	err error) {
+	if a == nil {
+		return
+	}
+
+	rec := &audit.Record{
+		Time:        startedAt,
+		RemoteAddr:  r.RemoteAddr,
+		Query:       query,
+		Repos:       repos,
+		Options:     opt,
+		DurationMs:  int(time.Since(startedAt).Seconds() * 1000),
+		FilesOpened: filesOpened,
+	}
+
+	if host, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		rec.RemoteAddr = host
+	}
+
+	if id := auth.IdentityFrom(r); id != nil {
+		rec.User = id.User
+	}
+
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	for _, res := range results {
+		rec.Results += res.FilesWithMatch
+	}
+
+	a.Log(rec)
+}
+
+// Parse a list of repos from the given searchers, idx must already be
+// limited to the repos that are visible to the caller.
 func parseAsRepoList(v string, idx map[string]*searcher.Searcher) []string {
 	v = strings.TrimSpace(v)
 	var repos []string
@@ -174,53 +321,172 @@ func parseRangeValue(rv string) (int, int) {
 	return b, e
 }
 
-func Setup(m *http.ServeMux, idx map[string]*searcher.Searcher, defaultMaxResults int) {
-	m.HandleFunc("/api/v1/repos", func(w http.ResponseWriter, r *http.Request) {
-		res := map[string]*config.Repo{}
-		for name, srch := range idx {
-			res[name] = srch.Repo
+// Parse the options of a search from the request's form values. Searches
+// and their explanations share these, so that both filter files the same
+// way.
+func parseSearchOptions(r *http.Request, defaultMaxResults int) (*index.SearchOptions, error) {
+	var opt index.SearchOptions
+	opt.Offset, opt.Limit = parseRangeValue(r.FormValue("rng"))
+	opt.FileRegexp = r.FormValue("files")
+	opt.ExcludeFileRegexp = r.FormValue("excludeFiles")
+	opt.IgnoreCase = parseAsBool(r.FormValue("i"))
+	opt.LiteralSearch = parseAsBool(r.FormValue("literal"))
+	opt.Type = r.FormValue("type")
+	opt.Language = r.FormValue("lang")
+	opt.MaxResults = parseAsIntValue(
+		r.FormValue("limit"),
+		-1,
+		maxLimit,
+		defaultMaxResults)
+	opt.LinesOfContext = parseAsUintValue(
+		r.FormValue("ctx"),
+		0,
+		maxLinesOfContext,
+		defaultLinesOfContext)
+
+	var err error
+	if opt.Language != "" {
+		if err := index.ValidateLanguage(opt.Language); err != nil {
+			return nil, err
+		}
+	}
+	if opt.Exclude, err = index.ParseFileClasses(r.FormValue("exclude")); err != nil {
+		return nil, err
+	}
+	if opt.DownRank, err = index.ParseFileClasses(r.FormValue("downrank")); err != nil {
+		return nil, err
+	}
+
+	return &opt, nil
+}
+
+// Merge the results of searching peers into the local results. Local repos
+// take precedence over a peer's repo with the same namespaced name.
+func mergePeerResults(results map[string]*index.SearchResponse, fed *federation.Result) {
+	for repo, res := range fed.Results {
+		if _, ok := results[repo]; ok {
+			continue
+		}
+		results[repo] = res
+	}
+}
+
+// Setup registers the API routes under basePath.
+func Setup(
+	m *http.ServeMux,
+	idx map[string]*searcher.Searcher,
+	peers *federation.Peers,
+	auditLog *audit.Logger,
+	savedSearches *saved.Store,
+	search *config.SearchConfig,
+	basePath string,
+	defaultMaxResults int) {
+	admit := newAdmission(search)
+	pool := newWorkerPool(search)
+
+	// Saved searches wait their turn like the ones from requests.
+	savedSearches.SetLimiter(func(fn func()) bool {
+		if !admit.acquire(context.Background()) {
+			return false
+		}
+		defer admit.release()
+
+		pool.wait(fn)
+		return true
+	})
+
+	m.HandleFunc(basePath+"/api/v1/repos", func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]*repoInfo{}
+		if peers != nil && !parseAsBool(r.FormValue("local")) {
+			for name, repo := range peers.Repos() {
+				res[name] = &repoInfo{Repo: repo}
+			}
+		}
+
+		for name, srch := range visibleRepos(r, idx) {
+			res[name] = &repoInfo{
+				Repo:      srch.Repo.Public(),
+				Languages: srch.Languages(),
+			}
 		}
 
 		writeResp(w, res)
 	})
 
-	m.HandleFunc("/api/v1/search", func(w http.ResponseWriter, r *http.Request) {
-		var opt index.SearchOptions
+	m.HandleFunc(basePath+"/api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]*searcher.Status{}
+		for name, srch := range visibleRepos(r, idx) {
+			res[name] = srch.Status()
+		}
+
+		writeResp(w, res)
+	})
 
+	m.HandleFunc(basePath+"/api/v1/search", func(w http.ResponseWriter, r *http.Request) {
+		visible := visibleRepos(r, idx)
 		stats := parseAsBool(r.FormValue("stats"))
-		repos := parseAsRepoList(r.FormValue("repos"), idx)
+		repos := parseAsRepoList(r.FormValue("repos"), visible)
 		query := r.FormValue("q")
-		opt.Offset, opt.Limit = parseRangeValue(r.FormValue("rng"))
-		opt.FileRegexp = r.FormValue("files")
-		opt.ExcludeFileRegexp = r.FormValue("excludeFiles")
-		opt.IgnoreCase = parseAsBool(r.FormValue("i"))
-		opt.LiteralSearch = parseAsBool(r.FormValue("literal"))
-		opt.MaxResults = parseAsIntValue(
-			r.FormValue("limit"),
-			-1,
-			maxLimit,
-			defaultMaxResults)
-		opt.LinesOfContext = parseAsUintValue(
-			r.FormValue("ctx"),
-			0,
-			maxLinesOfContext,
-			defaultLinesOfContext)
+
+		opt, err := parseSearchOptions(r, defaultMaxResults)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if !admit.acquire(r.Context()) {
+			w.Header().Set("Retry-After", strconv.Itoa(admit.retryAfter()))
+			writeError(w,
+				errors.New("Too many searches are in progress, try again later."),
+				http.StatusTooManyRequests)
+			return
+		}
+		defer admit.release()
 
 		var filesOpened int
 		var durationMs int
 
-		results, err := searchAll(query, &opt, repos, idx, &filesOpened, &durationMs)
+		// Peers are searched alongside the local repos unless this request
+		// was forwarded from another Hound server.
+		var peerCh chan *federation.Result
+		if peers != nil && !parseAsBool(r.FormValue("local")) {
+			if sel := peers.Select(r.FormValue("repos")); len(sel) > 0 {
+				peerCh = make(chan *federation.Result, 1)
+				go func() {
+					peerCh <- peers.Search(r.Form, sel)
+				}()
+			}
+		}
+
+		startedAt := time.Now()
+		results, err := searchAll(pool, query, opt, repos, visible, &filesOpened, &durationMs)
 		if err != nil {
+			logSearch(auditLog, r, query, repos, opt, nil, filesOpened, startedAt, err)
 			// TODO(knorton): Return ok status because the UI expects it for now.
 			writeError(w, err, http.StatusOK)
 			return
 		}
+		countDuplicates(results, visible)
+		if parseAsBool(r.FormValue("blame")) {
+			blameAll(pool, results, visible)
+		}
 
 		var res struct {
-			Results map[string]*index.SearchResponse
-			Stats   *Stats `json:",omitempty"`
+			Results    map[string]*index.SearchResponse
+			Stats      *Stats            `json:",omitempty"`
+			PeerErrors map[string]string `json:",omitempty"`
+		}
+
+		if peerCh != nil {
+			fed := <-peerCh
+			mergePeerResults(results, fed)
+			filesOpened += fed.FilesOpened
+			durationMs = int(time.Since(startedAt).Seconds() * 1000)
+			res.PeerErrors = fed.Errors
 		}
 
+		logSearch(auditLog, r, query, repos, opt, results, filesOpened, startedAt, nil)
+
 		res.Results = results
 		if stats {
 			res.Stats = &Stats{
@@ -232,15 +498,131 @@ func Setup(m *http.ServeMux, idx map[string]*searcher.Searcher, defaultMaxResult
 		writeResp(w, &res)
 	})
 
-	m.HandleFunc("/api/v1/excludes", func(w http.ResponseWriter, r *http.Request) {
+	m.HandleFunc(basePath+"/api/v1/saved-searches", func(w http.ResponseWriter, r *http.Request) {
+		if savedSearches == nil {
+			writeError(w, errors.New("Saved searches are not configured."), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeResp(w, savedSearches.List(auth.IdentityFrom(r)))
+		case http.MethodPost:
+			var s saved.Search
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+
+			if err := s.Validate(); err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+
+			s.Owner = auth.IdentityFrom(r)
+			if err := savedSearches.Add(&s); err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			writeResp(w, &s)
+		case http.MethodDelete:
+			name := r.FormValue("name")
+			ok, err := savedSearches.Remove(name, auth.IdentityFrom(r))
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				writeError(w, fmt.Errorf("No saved search named %q.", name), http.StatusNotFound)
+				return
+			}
+			writeResp(w, map[string]string{"Removed": name})
+		default:
+			writeError(w, errors.New("Method not allowed."), http.StatusMethodNotAllowed)
+		}
+	})
+
+	m.HandleFunc(basePath+"/api/v1/explain", func(w http.ResponseWriter, r *http.Request) {
+		visible := visibleRepos(r, idx)
+		repoList := r.FormValue("repos")
+		if repoList == "" {
+			repoList = "*"
+		}
+		repos := parseAsRepoList(repoList, visible)
+		query := r.FormValue("q")
+
+		opt, err := parseSearchOptions(r, defaultMaxResults)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		type repoExplanation struct {
+			Candidates int
+			Files      int
+		}
+
+		var res struct {
+			Query    string
+			AllFiles bool
+			Repos    map[string]*repoExplanation
+		}
+
+		plan, err := index.QueryPlan(query, opt)
+		if err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		res.Query = plan
+		res.Repos = map[string]*repoExplanation{}
+
+		if !admit.acquire(r.Context()) {
+			w.Header().Set("Retry-After", strconv.Itoa(admit.retryAfter()))
+			writeError(w,
+				errors.New("Too many searches are in progress, try again later."),
+				http.StatusTooManyRequests)
+			return
+		}
+		defer admit.release()
+
+		for _, repo := range repos {
+			var e *index.Explanation
+			pool.wait(func() {
+				e, err = visible[repo].Explain(query, opt)
+			})
+
+			// only invalid options make this fail.
+			if err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+			res.AllFiles = e.AllFiles
+			res.Repos[repo] = &repoExplanation{
+				Candidates: e.Candidates,
+				Files:      e.Files,
+			}
+		}
+
+		writeResp(w, &res)
+	})
+
+	m.HandleFunc(basePath+"/api/v1/excludes", func(w http.ResponseWriter, r *http.Request) {
 		repo := r.FormValue("repo")
-		res := idx[repo].GetExcludedFiles()
+		srch := visibleRepos(r, idx)[repo]
+		if srch == nil {
+			writeError(w,
+				fmt.Errorf("No such repository: %s", repo),
+				http.StatusNotFound)
+			return
+		}
+
+		res := srch.GetExcludedFiles()
 		w.Header().Set("Content-Type", "application/json;charset=utf-8")
 		w.Header().Set("Access-Control-Allow", "*")
 		fmt.Fprint(w, res)
 	})
 
-	m.HandleFunc("/api/v1/update", func(w http.ResponseWriter, r *http.Request) {
+	m.HandleFunc(basePath+"/api/v1/update", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			writeError(w,
 				errors.New(http.StatusText(http.StatusMethodNotAllowed)),
@@ -248,10 +630,11 @@ func Setup(m *http.ServeMux, idx map[string]*searcher.Searcher, defaultMaxResult
 			return
 		}
 
-		repos := parseAsRepoList(r.FormValue("repos"), idx)
+		visible := visibleRepos(r, idx)
+		repos := parseAsRepoList(r.FormValue("repos"), visible)
 
 		for _, repo := range repos {
-			searcher := idx[repo]
+			searcher := visible[repo]
 			if searcher == nil {
 				writeError(w,
 					fmt.Errorf("No such repository: %s", repo),
@@ -271,7 +654,7 @@ func Setup(m *http.ServeMux, idx map[string]*searcher.Searcher, defaultMaxResult
 		writeResp(w, "ok")
 	})
 
-	m.HandleFunc("/api/v1/github-webhook", func(w http.ResponseWriter, r *http.Request) {
+	m.HandleFunc(basePath+"/api/v1/github-webhook", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			writeError(w,
 				errors.New(http.StatusText(http.StatusMethodNotAllowed)),
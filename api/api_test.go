@@ -1,7 +1,14 @@
 package api
 
 import (
+	"net/http/httptest"
+	"reflect"
+	"sort"
 	"testing"
+
+	"github.com/hound-search/hound/auth"
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/searcher"
 )
 
 var parseAsIntAndUintTests = map[string]struct {
@@ -31,4 +38,63 @@ func TestParseAsIntAndUint(t *testing.T) {
 				}
 		})	
 	}
-}
\ No newline at end of file
+}
+func TestReposAreFilteredByIdentity(t *testing.T) {
+	idx := map[string]*searcher.Searcher{
+		"open":     {Repo: &config.Repo{}},
+		"payments": {Repo: &config.Repo{AllowedGroups: []string{"payments"}}},
+	}
+
+	tests := []struct {
+		id       *auth.Identity
+		repos    string
+		expected []string
+	}{
+		{nil, "*", []string{"open"}},
+		{nil, "open,payments", []string{"open"}},
+		{&auth.Identity{User: "alice", Groups: []string{"payments"}}, "*", []string{"open", "payments"}},
+		{&auth.Identity{User: "bob"}, "payments", nil},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/search?repos="+test.repos, nil)
+		if test.id != nil {
+			r = r.WithContext(auth.WithIdentity(r.Context(), test.id))
+		}
+
+		repos := parseAsRepoList(r.FormValue("repos"), visibleRepos(r, idx))
+		sort.Strings(repos)
+		if !reflect.DeepEqual(repos, test.expected) {
+			t.Errorf("%+v repos=%s: expected %v, got %v", test.id, test.repos, test.expected, repos)
+		}
+	}
+}
+
+// A peer passes its results on to callers that it can't check against our
+// access lists, so it never sees restricted repos.
+func TestForwardedRequestsHideRestrictedRepos(t *testing.T) {
+	idx := map[string]*searcher.Searcher{
+		"open":     {Repo: &config.Repo{}},
+		"payments": {Repo: &config.Repo{AllowedGroups: []string{"payments"}}},
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search?repos=*&local=true", nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{User: "peer", Groups: []string{"payments"}}))
+
+	repos := parseAsRepoList(r.FormValue("repos"), visibleRepos(r, idx))
+	if !reflect.DeepEqual(repos, []string{"open"}) {
+		t.Fatalf("expected only the open repo, got %v", repos)
+	}
+}
+
+func TestParseSearchOptionsLanguage(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/search?q=a&lang=terraform", nil)
+	if opt, err := parseSearchOptions(r, 100); err != nil || opt.Language != "terraform" {
+		t.Fatalf("expected the language to be kept, got %v %v", opt, err)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/search?q=a&lang=golang", nil)
+	if _, err := parseSearchOptions(r, 100); err == nil {
+		t.Fatal("expected an unknown language to be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+// Limits the number of searches that run at once, letting a bounded number
+// more wait for their turn.
+type admission struct {
+	running chan struct{}
+	queued  chan struct{}
+	timeout time.Duration
+}
+
+// Returns nil, which admits every search, if concurrent searches aren't
+// limited.
+func newAdmission(cfg *config.SearchConfig) *admission {
+	if cfg == nil || cfg.MaxConcurrentSearches <= 0 {
+		return nil
+	}
+
+	return &admission{
+		running: make(chan struct{}, cfg.MaxConcurrentSearches),
+		queued:  make(chan struct{}, cfg.MaxQueuedSearches),
+		timeout: time.Duration(cfg.QueueTimeoutMs) * time.Millisecond,
+	}
+}
+
+// Wait for a turn to search. Returns false if the queue is full or the turn
+// doesn't come soon enough, otherwise release must be called once the
+// search is done.
+func (a *admission) acquire(ctx context.Context) bool {
+	if a == nil {
+		return true
+	}
+
+	select {
+	case a.running <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case a.queued <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-a.queued }()
+
+	t := time.NewTimer(a.timeout)
+	defer t.Stop()
+
+	select {
+	case a.running <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (a *admission) release() {
+	if a != nil {
+		<-a.running
+	}
+}
+
+// How many seconds a client that was turned away should wait before trying
+// again.
+func (a *admission) retryAfter() int {
+	if s := int(a.timeout / time.Second); s > 0 {
+		return s
+	}
+	return 1
+}
+
+// A fixed number of goroutines that repos are searched on, so that the
+// memory used by searches doesn't grow with the number of requests.
+type workerPool struct {
+	jobs chan func()
+}
+
+// Returns nil, which runs each job on a new goroutine, if the number of
+// workers isn't limited.
+func newWorkerPool(cfg *config.SearchConfig) *workerPool {
+	if cfg == nil || cfg.Workers <= 0 {
+		return nil
+	}
+
+	p := &workerPool{
+		jobs: make(chan func()),
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			for fn := range p.jobs {
+				fn()
+			}
+		}()
+	}
+
+	return p
+}
+
+// Run fn on a worker, waiting for one to be free.
+func (p *workerPool) run(fn func()) {
+	if p == nil {
+		go fn()
+		return
+	}
+	p.jobs <- fn
+}
+
+// Run fn on a worker and wait for it to finish.
+func (p *workerPool) wait(fn func()) {
+	done := make(chan struct{})
+	p.run(func() {
+		defer close(done)
+		fn()
+	})
+	<-done
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(&config.SearchConfig{
+		MaxConcurrentSearches: 1,
+		MaxQueuedSearches:     1,
+		QueueTimeoutMs:        1000,
+	})
+	ctx := context.Background()
+
+	if !a.acquire(ctx) {
+		t.Fatal("expected the first search to be admitted")
+	}
+
+	// The second search waits for the first to finish.
+	admitted := make(chan bool)
+	go func() {
+		admitted <- a.acquire(ctx)
+	}()
+
+	// Wait for it to be queued, then a third search is turned away.
+	for len(a.queued) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if a.acquire(ctx) {
+		t.Fatal("expected a search to be turned away when the queue is full")
+	}
+
+	a.release()
+	if !<-admitted {
+		t.Fatal("expected the queued search to be admitted")
+	}
+
+	// A queued search gives up after the timeout.
+	a.timeout = 10 * time.Millisecond
+	if a.acquire(ctx) {
+		t.Fatal("expected a search to give up waiting")
+	}
+	a.release()
+
+	// Unlimited when not configured.
+	if newAdmission(nil) != nil || newAdmission(&config.SearchConfig{Workers: 4}) != nil {
+		t.Fatal("expected searches not to be limited")
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(&config.SearchConfig{Workers: 2})
+
+	started := make(chan struct{}, 3)
+	unblock := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		p.run(func() {
+			started <- struct{}{}
+			<-unblock
+		})
+	}
+
+	// A third job waits for a worker to be free.
+	queued := make(chan struct{})
+	go func() {
+		p.run(func() { started <- struct{}{} })
+		close(queued)
+	}()
+
+	<-started
+	<-started
+	select {
+	case <-queued:
+		t.Fatal("expected the third job to wait for a worker")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(unblock)
+	<-queued
+	<-started
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+)
+
+// A search as it is written to the audit log.
+type Record struct {
+	Time        time.Time
+	User        string `json:",omitempty"`
+	RemoteAddr  string
+	Query       string
+	Repos       []string
+	Options     *index.SearchOptions
+	DurationMs  int
+	FilesOpened int
+
+	// The number of files with a match.
+	Results int
+	Error   string `json:",omitempty"`
+
+	// The trigram query used to find candidate files, only included in the
+	// slow query log.
+	Plan string `json:",omitempty"`
+}
+
+// Logger writes searches to the audit log and the slow ones to the slow
+// query log. A nil Logger logs nothing.
+type Logger struct {
+	all  *rotatingFile
+	slow *rotatingFile
+
+	slowAfter time.Duration
+}
+
+// New opens the logs in cfg, returning nil if none are configured.
+func New(cfg *config.AuditLogConfig) (*Logger, error) {
+	if cfg == nil || (cfg.File == "" && cfg.SlowQueryFile == "") {
+		return nil, nil
+	}
+
+	l := &Logger{
+		slowAfter: time.Duration(cfg.SlowQueryMs) * time.Millisecond,
+	}
+	maxSize := int64(cfg.MaxSizeMB) * 1024 * 1024
+
+	if cfg.File != "" {
+		f, err := openRotating(cfg.File, maxSize, cfg.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		l.all = f
+	}
+
+	// Without a threshold every search would be slow.
+	if cfg.SlowQueryFile != "" && cfg.SlowQueryMs <= 0 {
+		log.Printf("not writing slow query log %s, slow-query-ms is not set", cfg.SlowQueryFile)
+	} else if cfg.SlowQueryFile != "" {
+		f, err := openRotating(cfg.SlowQueryFile, maxSize, cfg.MaxFiles)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.slow = f
+	}
+
+	return l, nil
+}
+
+func write(f *rotatingFile, rec *Record) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("failed to encode audit record: %s", err)
+		return
+	}
+
+	if err := f.WriteLine(append(b, '\n')); err != nil {
+		log.Printf("failed to write audit log %s: %s", f.name, err)
+	}
+}
+
+// Log a search. Failures are logged rather than returned so that they never
+// fail the search itself.
+func (l *Logger) Log(rec *Record) {
+	if l == nil {
+		return
+	}
+
+	if l.all != nil {
+		write(l.all, rec)
+	}
+
+	if l.slow != nil && time.Duration(rec.DurationMs)*time.Millisecond >= l.slowAfter {
+		slow := *rec
+		plan, err := index.QueryPlan(rec.Query, rec.Options)
+		if err != nil {
+			plan = err.Error()
+		}
+		slow.Plan = plan
+		write(l.slow, &slow)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	var err error
+	for _, f := range []*rotatingFile{l.all, l.slow} {
+		if f == nil {
+			continue
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
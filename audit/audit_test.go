@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+)
+
+func readRecords(t *testing.T, name string) []*Record {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var recs []*Record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, &rec)
+	}
+	return recs
+}
+
+func TestSlowQueriesIncludePlan(t *testing.T) {
+	dir := t.TempDir()
+	l, err := New(&config.AuditLogConfig{
+		File:          filepath.Join(dir, "audit.log"),
+		SlowQueryFile: filepath.Join(dir, "slow.log"),
+		SlowQueryMs:   100,
+		MaxSizeMB:     1,
+		MaxFiles:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &index.SearchOptions{IgnoreCase: true}
+	l.Log(&Record{User: "alice", Query: "fast", Options: opt, DurationMs: 5})
+	l.Log(&Record{User: "alice", Query: "hello.*world", Options: opt, DurationMs: 250, Results: 3})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	all := readRecords(t, filepath.Join(dir, "audit.log"))
+	if len(all) != 2 || all[0].Query != "fast" || all[1].Plan != "" {
+		t.Fatalf("expected both searches in the audit log without a plan, got %+v", all)
+	}
+
+	slow := readRecords(t, filepath.Join(dir, "slow.log"))
+	if len(slow) != 1 || slow[0].Query != "hello.*world" || slow[0].Results != 3 {
+		t.Fatalf("expected only the slow search in the slow log, got %+v", slow)
+	}
+	if !strings.Contains(slow[0].Plan, "hel") || !strings.Contains(slow[0].Plan, "rld") {
+		t.Fatalf("expected the plan to include trigrams, got %q", slow[0].Plan)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	r, err := openRotating(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if err := r.WriteLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		name:        "four\nfive\n",
+		name + ".1": "three\n",
+		name + ".2": "one\ntwo\n",
+	}
+	for file, content := range expected {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("%s: expected %q, got %q", file, content, b)
+		}
+	}
+
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Error("expected no more than 2 old files")
+	}
+}
+
+func TestSlowQueryLogNeedsThreshold(t *testing.T) {
+	dir := t.TempDir()
+	l, err := New(&config.AuditLogConfig{
+		File:          filepath.Join(dir, "audit.log"),
+		SlowQueryFile: filepath.Join(dir, "slow.log"),
+		MaxSizeMB:     1,
+		MaxFiles:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Log(&Record{Query: "fast", Options: &index.SearchOptions{}, DurationMs: 5})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "slow.log")); !os.IsNotExist(err) {
+		t.Fatal("expected no slow query log without slow-query-ms")
+	}
+}
+
+// Lines keep going to the current file when it can't be rotated.
+func TestRotateFailure(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+
+	// A directory that isn't empty can't be replaced by the old file.
+	if err := os.MkdirAll(filepath.Join(name+".1", "keep"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotating(name, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		if err := r.WriteLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "one\ntwo\nthree\nfour\n" {
+		t.Fatalf("expected every line, got %q", b)
+	}
+}
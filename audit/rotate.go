@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// A log file that is renamed to name.1 once it grows past maxSize, with
+// older copies shifted along up to name.<maxFiles>.
+type rotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	lck  sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotating(name string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		name:     name,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	old := r.f
+	r.f = f
+	r.size = fi.Size()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Move the file aside and start a new one. The current file is only closed
+// once the new one is open, so if rotating fails lines keep being written
+// to it, wherever it ended up.
+func (r *rotatingFile) rotate() error {
+	for i := r.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(r.name, r.name+".1"); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+// Write a single line, rotating first if it would make the file too big.
+func (r *rotatingFile) WriteLine(b []byte) error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	if r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Printf("failed to rotate %s: %s", r.name, err)
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) Close() error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return r.f.Close()
+}
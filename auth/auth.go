@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hound-search/hound/config"
+)
+
+// Returned by an Authenticator when a request carries credentials that it
+// understands but that are not valid.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// The authenticated caller of a request.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// An Authenticator determines who made a request. It returns a nil Identity
+// (and a nil error) when the request has no credentials it understands so
+// that another Authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// CanAccess reports whether the caller may see the repo. Repos that don't
+// list allowed users or groups are visible to everyone, restricted repos are
+// never visible to unauthenticated callers. It is safe to call on nil.
+func (id *Identity) CanAccess(repo *config.Repo) bool {
+	if !repo.IsRestricted() {
+		return true
+	}
+
+	if id == nil {
+		return false
+	}
+
+	for _, u := range repo.AllowedUsers {
+		if u == id.User {
+			return true
+		}
+	}
+
+	for _, g := range repo.AllowedGroups {
+		for _, ig := range id.Groups {
+			if g == ig {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type contextKey struct{}
+
+// Attach the identity of the caller to the request context.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// Get the identity of the caller of the request, or nil if the request is
+// not authenticated.
+func IdentityFrom(r *http.Request) *Identity {
+	id, _ := r.Context().Value(contextKey{}).(*Identity)
+	return id
+}
+
+// Checks for static tokens in Authorization: Bearer headers.
+type tokenAuth struct {
+	tokens []*config.AuthToken
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+
+	tok := []byte(strings.TrimSpace(h[len("Bearer "):]))
+	if len(tok) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+
+	for _, t := range a.tokens {
+		// an empty token would match an empty header.
+		if t.Token == "" {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(tok, []byte(t.Token)) == 1 {
+			return &Identity{User: t.User, Groups: t.Groups}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Checks HTTP basic auth credentials against an htpasswd file.
+type basicAuth struct {
+	file *htpasswdFile
+}
+
+func (a *basicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	valid, err := a.file.check(user, pass)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{User: user}, nil
+}
+
+// Trusts identity headers set by a reverse proxy on requests that come
+// from one of the trusted networks.
+type proxyHeaderAuth struct {
+	userHeader   string
+	groupsHeader string
+	trusted      []*net.IPNet
+}
+
+func (a *proxyHeaderAuth) isTrusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *proxyHeaderAuth) Authenticate(r *http.Request) (*Identity, error) {
+	user := r.Header.Get(a.userHeader)
+	if user == "" || !a.isTrusted(r.RemoteAddr) {
+		return nil, nil
+	}
+
+	id := &Identity{User: user}
+	if a.groupsHeader != "" {
+		for _, g := range strings.Split(r.Header.Get(a.groupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	}
+	return id, nil
+}
+
+func newProxyHeaderAuth(cfg *config.ProxyHeaderAuth) (*proxyHeaderAuth, error) {
+	a := &proxyHeaderAuth{
+		userHeader:   cfg.UserHeader,
+		groupsHeader: cfg.GroupsHeader,
+	}
+
+	if len(cfg.TrustedCIDRs) == 0 {
+		return nil, errors.New("auth: proxy-header requires at least one trusted-cidrs entry")
+	}
+
+	for _, c := range cfg.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("auth: invalid trusted cidr %q: %s", c, err)
+		}
+		a.trusted = append(a.trusted, n)
+	}
+	return a, nil
+}
+
+// A Chain tries each of its Authenticators in turn and requires that one of
+// them identifies the caller.
+type Chain struct {
+	auths []Authenticator
+
+	// Ask browsers to prompt for a password when it would be accepted.
+	basic bool
+
+	// Send browsers to log in when OpenID Connect is configured.
+	oidc *oidcAuth
+
+	// The path that Hound is served under.
+	basePath string
+}
+
+// Create the chain of Authenticators described by the config for a server
+// whose routes are under basePath. Returns nil if authentication is not
+// configured.
+func New(cfg *config.AuthConfig, basePath string) (*Chain, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	c := &Chain{basePath: basePath}
+
+	if cfg.ProxyHeader != nil {
+		a, err := newProxyHeaderAuth(cfg.ProxyHeader)
+		if err != nil {
+			return nil, err
+		}
+		c.auths = append(c.auths, a)
+	}
+
+	if len(cfg.Tokens) > 0 {
+		c.auths = append(c.auths, &tokenAuth{cfg.Tokens})
+	}
+
+	if cfg.HtpasswdFile != "" {
+		f, err := loadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		c.auths = append(c.auths, &basicAuth{f})
+		c.basic = true
+	}
+
+	if cfg.OIDC != nil {
+		a, err := newOIDCAuth(cfg.OIDC, basePath)
+		if err != nil {
+			return nil, err
+		}
+		c.auths = append(c.auths, a)
+		c.oidc = a
+	}
+
+	if len(c.auths) == 0 {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+// Authenticate returns the identity of the caller. If none of the
+// Authenticators identify the caller, an error is returned.
+func (c *Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c.auths {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if id != nil {
+			return id, nil
+		}
+	}
+	return nil, errors.New("authentication required")
+}
+
+// ServeLogin handles the requests under LoginPrefix (after the base path),
+// which must be allowed through without being authenticated.
+func (c *Chain) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	if c.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c.oidc.ServeHTTP(w, r)
+}
+
+// Pages are loaded by browsers that can be sent to log in, the API is used
+// by scripts and the UI which need to see the error instead.
+func (c *Chain) isPageRequest(r *http.Request) bool {
+	return r.Method == "GET" && !strings.HasPrefix(r.URL.Path, c.basePath+"/api/")
+}
+
+// Reject a request that could not be authenticated.
+func (c *Chain) Unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	if c.oidc != nil && err != ErrInvalidCredentials && c.isPageRequest(r) {
+		http.Redirect(w, r,
+			c.basePath+LoginPrefix+"login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(),
+			http.StatusFound)
+		return
+	}
+
+	if c.basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Hound", charset="UTF-8"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Hound"`)
+	}
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
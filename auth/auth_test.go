@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokens(t *testing.T) {
+	c, err := New(&config.AuthConfig{
+		Tokens: []*config.AuthToken{
+			{Token: "s3cret", User: "ci", Groups: []string{"bots"}},
+		},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	id, err := c.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "ci" || len(id.Groups) != 1 || id.Groups[0] != "bots" {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := c.Authenticate(r); err != ErrInvalidCredentials {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+
+	r.Header.Del("Authorization")
+	if _, err := c.Authenticate(r); err == nil {
+		t.Fatal("expected a request without credentials to be rejected")
+	}
+}
+
+// A token that was left empty in the config must not let in requests with
+// an empty bearer token.
+func TestEmptyTokens(t *testing.T) {
+	c, err := New(&config.AuthConfig{
+		Tokens: []*config.AuthToken{
+			{Token: "", User: "nobody"},
+		},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search", nil)
+	for _, h := range []string{"Bearer ", "Bearer", "Bearer    "} {
+		r.Header.Set("Authorization", h)
+		if id, err := c.Authenticate(r); err == nil {
+			t.Fatalf("expected %q to be rejected, got %+v", h, id)
+		}
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// password is the SHA1 of "password" as written by htpasswd -s.
+	path := writeHtpasswd(t,
+		"# users\nalice:"+string(hash)+"\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+
+	c, err := New(&config.AuthConfig{HtpasswdFile: path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"bob", "password", true},
+		{"bob", "hunter2", false},
+		{"carol", "password", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(test.user, test.pass)
+		id, err := c.Authenticate(r)
+		if test.ok && (err != nil || id.User != test.user) {
+			t.Errorf("expected %s to be authenticated, got %v", test.user, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("expected %s:%s to be rejected", test.user, test.pass)
+		}
+	}
+
+	// Changes to the file are picked up without a restart.
+	if err := os.WriteFile(path, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	if _, err := c.Authenticate(r); err == nil {
+		t.Fatal("expected alice to be rejected after being removed")
+	}
+}
+
+func TestUnsupportedHtpasswdHash(t *testing.T) {
+	path := writeHtpasswd(t, "alice:$apr1$abc$def\n")
+	if _, err := New(&config.AuthConfig{HtpasswdFile: path}, ""); err == nil {
+		t.Fatal("expected an error for an MD5 hash")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	c, err := New(&config.AuthConfig{
+		ProxyHeader: &config.ProxyHeaderAuth{
+			UserHeader:   "X-Forwarded-User",
+			GroupsHeader: "X-Forwarded-Groups",
+			TrustedCIDRs: []string{"10.0.0.0/8"},
+		},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.Header.Set("X-Forwarded-Groups", "eng, payments")
+
+	id, err := c.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "alice" || len(id.Groups) != 2 || id.Groups[1] != "payments" {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+
+	// The header can't be trusted from anywhere else.
+	r.RemoteAddr = "192.168.1.1:4567"
+	if _, err := c.Authenticate(r); err == nil {
+		t.Fatal("expected header from an untrusted address to be ignored")
+	}
+}
+
+func TestInvalidTrustedCIDR(t *testing.T) {
+	_, err := New(&config.AuthConfig{
+		ProxyHeader: &config.ProxyHeaderAuth{
+			UserHeader:   "X-Forwarded-User",
+			TrustedCIDRs: []string{"10.0.0.0"},
+		},
+	}, "")
+	if err == nil {
+		t.Fatal("expected an error for an invalid cidr")
+	}
+}
+
+func TestNotConfigured(t *testing.T) {
+	for _, cfg := range []*config.AuthConfig{nil, {}} {
+		c, err := New(cfg, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != nil {
+			t.Fatalf("expected no chain for %+v", cfg)
+		}
+	}
+}
+
+func TestCanAccess(t *testing.T) {
+	open := &config.Repo{}
+	restricted := &config.Repo{
+		AllowedUsers:  []string{"alice"},
+		AllowedGroups: []string{"payments"},
+	}
+
+	tests := []struct {
+		id        *Identity
+		repo      *config.Repo
+		canAccess bool
+		desc      string
+	}{
+		{nil, open, true, "unauthenticated, open repo"},
+		{nil, restricted, false, "unauthenticated, restricted repo"},
+		{&Identity{User: "alice"}, restricted, true, "allowed user"},
+		{&Identity{User: "bob", Groups: []string{"eng", "payments"}}, restricted, true, "allowed group"},
+		{&Identity{User: "bob", Groups: []string{"eng"}}, restricted, false, "neither"},
+	}
+
+	for _, test := range tests {
+		if got := test.id.CanAccess(test.repo); got != test.canAccess {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.canAccess, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An htpasswd file of user:hash lines. Hashes may be bcrypt (htpasswd -B) or
+// SHA1 (htpasswd -s). The file is reloaded when it changes on disk.
+type htpasswdFile struct {
+	path string
+
+	lck     sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+func loadHtpasswd(path string) (*htpasswdFile, error) {
+	f := &htpasswdFile{path: path}
+	if err := f.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseHtpasswd(path string) (map[string]string, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	users := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		ix := strings.Index(line, ":")
+		if ix <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+
+		hash := line[ix+1:]
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash, use bcrypt (-B) or SHA1 (-s)", path, n)
+		}
+
+		users[line[:ix]] = hash
+	}
+
+	return users, s.Err()
+}
+
+func (f *htpasswdFile) reloadIfChanged() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	if f.users != nil && fi.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	users, err := parseHtpasswd(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.users = users
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+// Check the password of the given user. If the file can no longer be read,
+// the users that were last loaded are used.
+func (f *htpasswdFile) check(user, pass string) (bool, error) {
+	f.lck.Lock()
+	if err := f.reloadIfChanged(); err != nil && f.users == nil {
+		f.lck.Unlock()
+		return false, err
+	}
+	hash, ok := f.users[user]
+	f.lck.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil, nil
+	}
+
+	sum := sha1.Sum([]byte(pass))
+	expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1, nil
+}
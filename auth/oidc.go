@@ -0,0 +1,644 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+const (
+	// Requests under this path (after the base path) are served by the
+	// Chain without being authenticated, they are how users log in.
+	LoginPrefix = "/auth/"
+
+	sessionCookie = "hound_session"
+	loginCookie   = "hound_login"
+
+	// How long a user has to complete a login with the provider.
+	loginTimeout = 10 * time.Minute
+
+	// How long to wait for the provider to respond.
+	providerTimeout = 10 * time.Second
+)
+
+// Logs users in with the authorization code flow of an OpenID Connect
+// provider and keeps them logged in with a signed session cookie.
+type oidcAuth struct {
+	cfg      *config.OIDCConfig
+	secret   []byte
+	client   *http.Client
+	basePath string
+
+	lck      sync.Mutex
+	provider *oidcProvider
+	keys     []*jwk
+}
+
+// The parts of the provider's discovery document that are used.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// A key from the provider's JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// The content of the session cookie.
+type session struct {
+	User    string
+	Groups  []string
+	Expires int64
+}
+
+// The content of the cookie that ties a callback to the login that started
+// it.
+type loginState struct {
+	State   string
+	Nonce   string
+	Next    string
+	Expires int64
+}
+
+func newOIDCAuth(cfg *config.OIDCConfig, basePath string) (*oidcAuth, error) {
+	secret := []byte(cfg.CookieSecret)
+	if len(secret) == 0 {
+		// Sessions won't survive a restart, but that only means logging in
+		// again.
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &oidcAuth{
+		cfg:      cfg,
+		secret:   secret,
+		client:   &http.Client{Timeout: providerTimeout},
+		basePath: basePath,
+	}, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// The name of the cookie is part of the MAC, so that the value of one
+// cookie can't be passed off as another.
+func (a *oidcAuth) mac(name, payload string) []byte {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write([]byte(name + "\x00" + payload)) //nolint
+	return m.Sum(nil)
+}
+
+// Encode v as the value of the named cookie that can't be forged without
+// the secret.
+func (a *oidcAuth) sign(name string, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.mac(name, payload)), nil
+}
+
+// Decode a value created by sign for the named cookie into v.
+func (a *oidcAuth) verify(name, s string, v interface{}) error {
+	ix := strings.Index(s, ".")
+	if ix < 0 {
+		return ErrInvalidCredentials
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(s[ix+1:])
+	if err != nil || !hmac.Equal(sig, a.mac(name, s[:ix])) {
+		return ErrInvalidCredentials
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s[:ix])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// A session that is missing, forged, expired or without a user is not an
+// error, it just means the user has to log in.
+func (a *oidcAuth) Authenticate(r *http.Request) (*Identity, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+
+	var s session
+	if err := a.verify(sessionCookie, c.Value, &s); err != nil || time.Now().Unix() > s.Expires || s.User == "" {
+		return nil, nil
+	}
+
+	return &Identity{User: s.User, Groups: s.Groups}, nil
+}
+
+func (a *oidcAuth) getJson(uri string, v interface{}) error {
+	res, err := a.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", uri, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Load the provider's discovery document the first time it is needed, so
+// that houndd can start while the provider is unreachable.
+func (a *oidcAuth) discover() (*oidcProvider, error) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	if a.provider != nil {
+		return a.provider, nil
+	}
+
+	var p oidcProvider
+	uri := strings.TrimSuffix(a.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := a.getJson(uri, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Issuer != a.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: provider reports issuer %q, expected %q", p.Issuer, a.cfg.Issuer)
+	}
+
+	a.provider = &p
+	return &p, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return err
+		}
+		k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if k.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return err
+		}
+		k.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	return nil
+}
+
+func (a *oidcAuth) loadKeys(p *oidcProvider) ([]*jwk, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := a.getJson(p.JwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []*jwk
+	for _, k := range set.Keys {
+		// Skip keys we can't use rather than failing, the provider may
+		// publish keys for other purposes.
+		if err := k.parse(); err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Find the keys that may have signed a token with the given key id. The key
+// set is reloaded when the id isn't known, since providers rotate keys.
+func (a *oidcAuth) keysFor(p *oidcProvider, kid string) ([]*jwk, error) {
+	find := func() []*jwk {
+		var res []*jwk
+		for _, k := range a.keys {
+			if kid == "" || k.Kid == kid {
+				res = append(res, k)
+			}
+		}
+		return res
+	}
+
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	if keys := find(); len(keys) > 0 {
+		return keys, nil
+	}
+
+	keys, err := a.loadKeys(p)
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+
+	if keys := find(); len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("oidc: no key with id %q", kid)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) bool {
+	h := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	}
+	return false
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the signature and claims of an ID token and return its claims.
+func (a *oidcAuth) verifyIDToken(p *oidcProvider, raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := a.keysFor(p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	verified := false
+	for _, k := range keys {
+		if verifySignature(header.Alg, k.key, parts[0]+"."+parts[1], sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("oidc: invalid id token signature")
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+
+	if claims["iss"] != a.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: id token issued by %v", claims["iss"])
+	}
+
+	if !hasAudience(claims["aud"], a.cfg.ClientID) {
+		return nil, errors.New("oidc: id token is for another client")
+	}
+
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().Unix() > int64(exp) {
+		return nil, errors.New("oidc: id token has expired")
+	}
+
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("oidc: id token nonce does not match")
+	}
+
+	return claims, nil
+}
+
+// Exchange an authorization code for an ID token.
+func (a *oidcAuth) exchange(p *oidcProvider, code, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.cfg.ClientID), url.QueryEscape(a.cfg.ClientSecret))
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return "", fmt.Errorf("oidc: token endpoint returned %s", res.Status)
+	}
+
+	if tok.Error != "" {
+		return "", fmt.Errorf("oidc: %s %s", tok.Error, tok.ErrorDescription)
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("oidc: token endpoint did not return an id token")
+	}
+	return tok.IDToken, nil
+}
+
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var res []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func (a *oidcAuth) redirectURL(r *http.Request) string {
+	if a.cfg.RedirectURL != "" {
+		return a.cfg.RedirectURL
+	}
+
+	scheme := "http"
+	if isSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + a.basePath + LoginPrefix + "callback"
+}
+
+// Only redirect to paths on this server after logging in, anything else
+// goes to home.
+func safeNext(next, home string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return home
+	}
+	return next
+}
+
+func (a *oidcAuth) setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *oidcAuth) login(w http.ResponseWriter, r *http.Request) {
+	p, err := a.discover()
+	if err != nil {
+		log.Printf("oidc: failed to load provider config: %s", err)
+		http.Error(w, "The login provider is unavailable.", http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	v, err := a.sign(loginCookie, &loginState{
+		State:   state,
+		Nonce:   nonce,
+		Next:    safeNext(r.FormValue("next"), a.basePath+"/"),
+		Expires: time.Now().Add(loginTimeout).Unix(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.setCookie(w, r, loginCookie, v, a.basePath+LoginPrefix, int(loginTimeout.Seconds()))
+
+	scopes := a.cfg.Scopes
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.cfg.ClientID},
+		"redirect_uri":  {a.redirectURL(r)},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (a *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	c, err := r.Cookie(loginCookie)
+	if err != nil {
+		http.Error(w, "Login expired, please try again.", http.StatusBadRequest)
+		return
+	}
+
+	var ls loginState
+	if err := a.verify(loginCookie, c.Value, &ls); err != nil || time.Now().Unix() > ls.Expires {
+		http.Error(w, "Login expired, please try again.", http.StatusBadRequest)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(ls.State), []byte(r.FormValue("state"))) != 1 {
+		http.Error(w, "Login state does not match.", http.StatusBadRequest)
+		return
+	}
+
+	p, err := a.discover()
+	if err != nil {
+		log.Printf("oidc: failed to load provider config: %s", err)
+		http.Error(w, "The login provider is unavailable.", http.StatusBadGateway)
+		return
+	}
+
+	raw, err := a.exchange(p, r.FormValue("code"), a.redirectURL(r))
+	if err != nil {
+		log.Printf("oidc: code exchange failed: %s", err)
+		http.Error(w, "Login failed.", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := a.verifyIDToken(p, raw, ls.Nonce)
+	if err != nil {
+		log.Printf("oidc: %s", err)
+		http.Error(w, "Login failed.", http.StatusUnauthorized)
+		return
+	}
+
+	s := &session{
+		Groups:  claimStrings(claims, a.cfg.GroupsClaim),
+		Expires: time.Now().Add(time.Duration(a.cfg.SessionHours) * time.Hour).Unix(),
+	}
+	if u := claimStrings(claims, a.cfg.UserClaim); len(u) > 0 {
+		s.User = u[0]
+	} else if sub, ok := claims["sub"].(string); ok {
+		s.User = sub
+	}
+	if s.User == "" {
+		log.Printf("oidc: id token has no %s or sub claim", a.cfg.UserClaim)
+		http.Error(w, "Login failed.", http.StatusUnauthorized)
+		return
+	}
+
+	v, err := a.sign(sessionCookie, s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.setCookie(w, r, loginCookie, "", a.basePath+LoginPrefix, -1)
+	a.setCookie(w, r, sessionCookie, v, a.basePath+"/", a.cfg.SessionHours*3600)
+	http.Redirect(w, r, ls.Next, http.StatusFound)
+}
+
+func (a *oidcAuth) logout(w http.ResponseWriter, r *http.Request) {
+	a.setCookie(w, r, sessionCookie, "", a.basePath+"/", -1)
+	http.Redirect(w, r, a.basePath+"/", http.StatusFound)
+}
+
+func (a *oidcAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, a.basePath+LoginPrefix) {
+	case "login":
+		a.login(w, r)
+	case "callback":
+		a.callback(w, r)
+	case "logout":
+		a.logout(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+// A minimal OpenID Connect provider that logs everyone in as the same user.
+type fakeIssuer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	lck    sync.Mutex
+	nonces map[string]string
+}
+
+func startIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeIssuer{t: t, key: key, nonces: map[string]string{}}
+	m := http.NewServeMux()
+	m.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	m.HandleFunc("/jwks", f.jwks)
+	m.HandleFunc("/authorize", f.authorize)
+	m.HandleFunc("/token", f.token)
+	f.Server = httptest.NewServer(m)
+	return f
+}
+
+func (f *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{ //nolint
+		"issuer":                 f.URL,
+		"authorization_endpoint": f.URL + "/authorize",
+		"token_endpoint":         f.URL + "/token",
+		"jwks_uri":               f.URL + "/jwks",
+	})
+}
+
+func (f *fakeIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	enc := base64.RawURLEncoding
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   enc.EncodeToString(f.key.N.Bytes()),
+			"e":   enc.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}},
+	})
+}
+
+// Skip the login page and send the user straight back with a code.
+func (f *fakeIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	code := "code-" + r.FormValue("state")
+	f.lck.Lock()
+	f.nonces[code] = r.FormValue("nonce")
+	f.lck.Unlock()
+
+	q := url.Values{"code": {code}, "state": {r.FormValue("state")}}
+	http.Redirect(w, r, r.FormValue("redirect_uri")+"?"+q.Encode(), http.StatusFound)
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != "hound" || secret != "s3cret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"}) //nolint
+		return
+	}
+
+	f.lck.Lock()
+	nonce, ok := f.nonces[r.FormValue("code")]
+	f.lck.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"}) //nolint
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{ //nolint
+		"id_token": f.sign(map[string]interface{}{
+			"iss":    f.URL,
+			"aud":    "hound",
+			"sub":    "1234",
+			"email":  "alice@example.com",
+			"groups": []string{"eng", "payments"},
+			"nonce":  nonce,
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}),
+	})
+}
+
+func (f *fakeIssuer) sign(claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	c, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, sum[:])
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func newOIDCChain(t *testing.T, issuer string) *Chain {
+	c, err := New(&config.AuthConfig{
+		OIDC: &config.OIDCConfig{
+			Issuer:       issuer,
+			ClientID:     "hound",
+			ClientSecret: "s3cret",
+			RedirectURL:  "http://hound.test/auth/callback",
+			Scopes:       []string{"openid", "email"},
+			UserClaim:    "email",
+			GroupsClaim:  "groups",
+			SessionHours: 1,
+		},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func cookieNamed(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Follow a login from the first page load until the session is created and
+// return the responses to the callback.
+func login(t *testing.T, c *Chain, issuer *fakeIssuer, tamper func(*url.URL)) *httptest.ResponseRecorder {
+	// Pages redirect to the login when there is no session.
+	r := httptest.NewRequest("GET", "/?q=foo", nil)
+	_, err := c.Authenticate(r)
+	if err == nil {
+		t.Fatal("expected a request without a session to be rejected")
+	}
+	w := httptest.NewRecorder()
+	c.Unauthorized(w, r, err)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to log in, got %d", w.Code)
+	}
+
+	loc := w.Result().Header.Get("Location")
+	if loc != "/auth/login?next=%2F%3Fq%3Dfoo" {
+		t.Fatalf("unexpected login url %s", loc)
+	}
+
+	w = httptest.NewRecorder()
+	c.ServeLogin(w, httptest.NewRequest("GET", loc, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the provider, got %d", w.Code)
+	}
+	state := cookieNamed(w.Result().Cookies(), loginCookie)
+
+	// Let the provider send us back with a code.
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(w.Result().Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	cb, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(cb)
+	}
+
+	r = httptest.NewRequest("GET", cb.RequestURI(), nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	c.ServeLogin(w, r)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := startIssuer(t)
+	defer issuer.Close()
+
+	c := newOIDCChain(t, issuer.URL)
+	w := login(t, c, issuer, nil)
+	if w.Code != http.StatusFound || w.Result().Header.Get("Location") != "/?q=foo" {
+		t.Fatalf("expected a redirect to the original page, got %d %s",
+			w.Code, w.Result().Header.Get("Location"))
+	}
+
+	sess := cookieNamed(w.Result().Cookies(), sessionCookie)
+	if sess == nil {
+		t.Fatal("expected a session cookie")
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search", nil)
+	r.AddCookie(sess)
+	id, err := c.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "alice@example.com" || strings.Join(id.Groups, ",") != "eng,payments" {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+
+	// A session can't be forged.
+	r = httptest.NewRequest("GET", "/api/v1/search", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "e30." + sess.Value[strings.Index(sess.Value, ".")+1:]})
+	if _, err = c.Authenticate(r); err == nil {
+		t.Fatal("expected a forged session to be rejected")
+	}
+
+	// The API gets an error rather than a redirect.
+	w = httptest.NewRecorder()
+	c.Unauthorized(w, r, err)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for the API, got %d", w.Code)
+	}
+}
+
+// The login cookie is signed with the same secret as the session, but it
+// can't be used as one.
+func TestOIDCLoginCookieIsNotASession(t *testing.T) {
+	issuer := startIssuer(t)
+	defer issuer.Close()
+
+	c := newOIDCChain(t, issuer.URL)
+	w := httptest.NewRecorder()
+	c.ServeLogin(w, httptest.NewRequest("GET", "/auth/login", nil))
+	state := cookieNamed(w.Result().Cookies(), loginCookie)
+	if state == nil {
+		t.Fatal("expected a login cookie")
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: state.Value})
+	_, err := c.Authenticate(r)
+	if err == nil {
+		t.Fatal("expected the login cookie to be rejected as a session")
+	}
+
+	w = httptest.NewRecorder()
+	c.Unauthorized(w, r, err)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestOIDCLoginWithBadState(t *testing.T) {
+	issuer := startIssuer(t)
+	defer issuer.Close()
+
+	c := newOIDCChain(t, issuer.URL)
+	w := login(t, c, issuer, func(u *url.URL) {
+		q := u.Query()
+		q.Set("state", "forged")
+		u.RawQuery = q.Encode()
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a bad request, got %d", w.Code)
+	}
+	if cookieNamed(w.Result().Cookies(), sessionCookie) != nil {
+		t.Fatal("expected no session")
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	issuer := startIssuer(t)
+	defer issuer.Close()
+
+	a := newOIDCChain(t, issuer.URL).oidc
+	p, err := a.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]interface{}{
+		"iss":   issuer.URL,
+		"aud":   []string{"other", "hound"},
+		"sub":   "1234",
+		"nonce": "n",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	if _, err := a.verifyIDToken(p, issuer.sign(valid), "n"); err != nil {
+		t.Fatalf("expected a valid token, got %s", err)
+	}
+
+	tests := map[string]func(map[string]interface{}){
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"wrong nonce":    func(c map[string]interface{}) { c["nonce"] = "m" },
+	}
+
+	for name, change := range tests {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		change(claims)
+
+		if _, err := a.verifyIDToken(p, issuer.sign(claims), "n"); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+
+	// Tokens signed by another key are rejected.
+	other := startIssuer(t)
+	defer other.Close()
+	if _, err := a.verifyIDToken(p, other.sign(valid), "n"); err == nil {
+		t.Error("expected a token signed by another key to be rejected")
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	tests := map[string]string{
+		"/?q=foo":             "/?q=foo",
+		"":                    "/",
+		"https://example.com": "/",
+		"//example.com":       "/",
+		"/\\example.com":      "/",
+	}
+	for next, expected := range tests {
+		if got := safeNext(next, "/"); got != expected {
+			t.Errorf("safeNext(%q): expected %q, got %q", next, expected, got)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -73,8 +75,23 @@ func repoNameFor(repos map[string]*config.Repo, repo string) string {
 	return name
 }
 
-func doHttpGet(cfg *Config, uri string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", uri, nil)
+// Build the url for an API path on the configured host. Hosts without a
+// scheme are assumed to be http.
+func apiUrl(cfg *Config, path string, params url.Values) string {
+	host := cfg.Host
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	u := strings.TrimRight(host, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return u
+}
+
+func doHttpGet(ctx context.Context, cfg *Config, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -92,19 +109,21 @@ func doHttpGet(cfg *Config, uri string) (*http.Response, error) {
 }
 
 // Executes a search on the API running on host.
-func Search(r *Response, cfg *Config, pattern, repos, files string, context int, ignoreCase, stats bool) error {
-	u := fmt.Sprintf("http://%s/api/v1/search?%s",
-		cfg.Host,
-		url.Values{
-			"q":     {pattern},
-			"repos": {repos},
-			"files": {files},
-			"ctx":   {fmt.Sprintf("%d", context)},
-			"i":     {fmt.Sprintf("%t", ignoreCase)},
-			"stats": {fmt.Sprintf("%t", stats)},
-		}.Encode())
-
-	res, err := doHttpGet(cfg, u)
+func Search(r *Response, cfg *Config, pattern, repos, files string, linesOfContext int, ignoreCase, stats bool) error {
+	return SearchWithParams(context.Background(), r, cfg, url.Values{
+		"q":     {pattern},
+		"repos": {repos},
+		"files": {files},
+		"ctx":   {fmt.Sprintf("%d", linesOfContext)},
+		"i":     {fmt.Sprintf("%t", ignoreCase)},
+		"stats": {fmt.Sprintf("%t", stats)},
+	})
+}
+
+// Executes a search on the API running on host with the given query
+// parameters, which can be any of those accepted by the search API.
+func SearchWithParams(ctx context.Context, r *Response, cfg *Config, params url.Values) error {
+	res, err := doHttpGet(ctx, cfg, apiUrl(cfg, "/api/v1/search", params))
 	if err != nil {
 		return err
 	}
@@ -114,17 +133,41 @@ func Search(r *Response, cfg *Config, pattern, repos, files string, context int,
 		return fmt.Errorf("Status %d", res.StatusCode)
 	}
 
-	return json.NewDecoder(res.Body).Decode(r)
+	var body struct {
+		Response
+		Error string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	// the search API reports errors with an ok status.
+	if body.Error != "" {
+		return errors.New(body.Error)
+	}
+
+	*r = body.Response
+	return nil
 }
 
 // Load the list of repositories from the API running on host.
 func LoadRepos(repos map[string]*config.Repo, cfg *Config) error {
-	res, err := doHttpGet(cfg, fmt.Sprintf("http://%s/api/v1/repos", cfg.Host))
+	return LoadReposWithParams(context.Background(), repos, cfg, nil)
+}
+
+// Load the list of repositories from the API running on host with the given
+// query parameters.
+func LoadReposWithParams(ctx context.Context, repos map[string]*config.Repo, cfg *Config, params url.Values) error {
+	res, err := doHttpGet(ctx, cfg, apiUrl(cfg, "/api/v1/repos", params))
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status %d", res.StatusCode)
+	}
+
 	return json.NewDecoder(res.Body).Decode(&repos)
 }
 
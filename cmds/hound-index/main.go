@@ -0,0 +1,317 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/searcher"
+	"github.com/hound-search/hound/vcs"
+)
+
+const usage = `usage: hound-index <command> [flags]
+
+Commands:
+  build    build indexes that houndd can adopt from its dbpath
+  inspect  print the manifest and statistics of index directories
+  verify   check the trigrams of index directories against their raw files
+
+Run hound-index <command> -h for the flags of each command.
+`
+
+var (
+	info_log  *log.Logger
+	error_log *log.Logger
+)
+
+// Parse the comma separated list of repo names given in the -repos flag. An
+// empty list selects every repo in the config.
+func selectRepos(cfg *config.Config, v string) ([]string, error) {
+	var names []string
+	if v == "" {
+		for name := range cfg.Repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if cfg.Repos[name] == nil {
+			return nil, fmt.Errorf("No such repository: %s", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Index a working copy that has already been checked out, like the one a CI
+// job runs in. The repo settings either come from the config or the flags.
+func buildFromDir(repo *config.Repo, dir, rev, out string) error {
+	wd, err := vcs.New(repo.Vcs, repo.VcsConfig())
+	if err != nil {
+		return err
+	}
+
+	if rev == "" {
+		rev, err = wd.HeadRev(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	ref, err := searcher.BuildIndex(repo, wd, out, dir, rev)
+	if err != nil {
+		return err
+	}
+
+	info_log.Printf("indexed %s at %s into %s", repo.Url, rev, ref.Dir())
+	return nil
+}
+
+// Check out and index each of the named repos from the config. Failures are
+// reported per repo, returns false if any of them failed.
+func buildFromConfig(cfg *config.Config, names []string, work, out string) bool {
+	ok := true
+	for _, name := range names {
+		repo := cfg.Repos[name]
+
+		wd, vcsDir, rev, err := searcher.Checkout(work, repo)
+		if err != nil {
+			error_log.Printf("failed checkout (%s): %s", name, err)
+			ok = false
+			continue
+		}
+
+		ref, err := searcher.BuildIndex(repo, wd, out, vcsDir, rev)
+		if err != nil {
+			error_log.Printf("failed index build (%s): %s", name, err)
+			ok = false
+			continue
+		}
+
+		info_log.Printf("indexed %s at %s into %s", name, rev, ref.Dir())
+	}
+	return ok
+}
+
+func build(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flagConf := flags.String("conf", "", "houndd config to take the repos and their settings from")
+	flagRepos := flags.String("repos", "", "comma separated list of repos in the config to index (default all)")
+	flagDir := flags.String("dir", "", "index this existing working copy instead of checking out the repo")
+	flagUrl := flags.String("url", "", "url of the repo in -dir, must match the url houndd is configured with")
+	flagRev := flags.String("rev", "", "revision of the repo in -dir (default the head revision)")
+	flagVcs := flags.String("vcs", "git", "vcs of the repo in -dir")
+	flagExcludeDot := flags.Bool("exclude-dot-files", false, "exclude dot files from the repo in -dir, without -conf")
+	flagArchives := flags.Bool("index-archives", false, "index the members of archives in the repo in -dir, without -conf")
+	flagOut := flags.String("out", "", "directory to write idx-* directories to (default the config's dbpath)")
+	flagWork := flags.String("work", "", "directory to check repos out in (default -out)")
+	flags.Parse(args) //nolint
+
+	var cfg *config.Config
+	if *flagConf != "" {
+		// The settings of repos in the config come from the config, so
+		// flags that would override them aren't allowed.
+		var ignored []string
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "url", "vcs", "exclude-dot-files", "index-archives":
+				ignored = append(ignored, "-"+f.Name)
+			}
+		})
+		if len(ignored) > 0 {
+			error_log.Printf("%s can't be used with -conf, set them on the repo in the config instead", strings.Join(ignored, ", "))
+			return 2
+		}
+
+		cfg = &config.Config{}
+		if err := cfg.LoadFromFile(*flagConf); err != nil {
+			error_log.Println(err)
+			return 1
+		}
+	}
+
+	out := *flagOut
+	if out == "" && cfg != nil {
+		out = cfg.DbPath
+	}
+	if out == "" {
+		error_log.Println("either -out or -conf is required")
+		return 2
+	}
+
+	if err := os.MkdirAll(out, os.ModePerm); err != nil {
+		error_log.Println(err)
+		return 1
+	}
+
+	if *flagDir != "" {
+		var repo *config.Repo
+		if cfg != nil {
+			names, err := selectRepos(cfg, *flagRepos)
+			if err != nil {
+				error_log.Println(err)
+				return 2
+			}
+			if len(names) != 1 {
+				error_log.Println("-dir requires -repos to name a single repo from the config")
+				return 2
+			}
+			repo = cfg.Repos[names[0]]
+		} else {
+			if *flagUrl == "" {
+				error_log.Println("-dir requires either -url or -conf")
+				return 2
+			}
+			repo = &config.Repo{
+				Url:             *flagUrl,
+				Vcs:             *flagVcs,
+				ExcludeDotFiles: *flagExcludeDot,
+				IndexArchives:   *flagArchives,
+			}
+		}
+
+		if err := buildFromDir(repo, *flagDir, *flagRev, out); err != nil {
+			error_log.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	if cfg == nil {
+		error_log.Println("either -conf or -dir is required")
+		return 2
+	}
+
+	names, err := selectRepos(cfg, *flagRepos)
+	if err != nil {
+		error_log.Println(err)
+		return 2
+	}
+
+	work := *flagWork
+	if work == "" {
+		work = out
+	}
+
+	if err := os.MkdirAll(work, os.ModePerm); err != nil {
+		error_log.Println(err)
+		return 1
+	}
+
+	if !buildFromConfig(cfg, names, work, out) {
+		return 1
+	}
+	return 0
+}
+
+func inspect(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flagTop := flags.Int("top", 10, "number of the largest posting lists to print")
+	flagExcluded := flags.Bool("excluded", false, "print every excluded file rather than a count")
+	flags.Parse(args) //nolint
+
+	if flags.NArg() == 0 {
+		error_log.Println("inspect requires at least one index directory")
+		return 2
+	}
+
+	status := 0
+	for _, dir := range flags.Args() {
+		st, err := index.Inspect(dir, *flagTop)
+		if err != nil {
+			error_log.Printf("failed to inspect %s: %s", dir, err)
+			status = 1
+			continue
+		}
+
+		fmt.Printf("%s\n", dir)
+		fmt.Printf("  version:    %d (current %d)\n", st.Ref.Version, index.ManifestVersion)
+		fmt.Printf("  url:        %s\n", st.Ref.Url)
+		fmt.Printf("  rev:        %s\n", st.Ref.Rev)
+		fmt.Printf("  built:      %s\n", st.Ref.Time)
+		fmt.Printf("  files:      %d\n", st.Files)
+		fmt.Printf("  trigrams:   %d\n", st.Trigrams)
+		fmt.Printf("  postings:   %d\n", st.Postings)
+		fmt.Printf("  excluded:   %d\n", len(st.Excluded))
+		fmt.Printf("  generated:  %d\n", len(st.Ref.AutoGeneratedFiles))
+		for _, sub := range st.Ref.Submodules {
+			fmt.Printf("  submodule:  %s %s@%s\n", sub.Path, sub.Url, sub.Rev)
+		}
+
+		fmt.Printf("  largest posting lists:\n")
+		for _, l := range st.Largest {
+			fmt.Printf("    %-12q %d\n", l.Trigram, l.Files)
+		}
+
+		if *flagExcluded {
+			fmt.Printf("  excluded files:\n")
+			for _, f := range st.Excluded {
+				fmt.Printf("    %s: %s\n", f.Filename, f.Reason)
+			}
+		}
+	}
+	return status
+}
+
+func verify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args) //nolint
+
+	if flags.NArg() == 0 {
+		error_log.Println("verify requires at least one index directory")
+		return 2
+	}
+
+	status := 0
+	for _, dir := range flags.Args() {
+		errs, err := index.Verify(dir)
+		if err != nil {
+			error_log.Printf("failed to verify %s: %s", dir, err)
+			status = 1
+			continue
+		}
+
+		for _, e := range errs {
+			error_log.Printf("%s: %s", dir, e)
+		}
+
+		if len(errs) > 0 {
+			error_log.Printf("%s: %d files failed verification", dir, len(errs))
+			status = 1
+			continue
+		}
+
+		info_log.Printf("%s: ok", dir)
+	}
+	return status
+}
+
+func main() {
+	info_log = log.New(os.Stdout, "", log.LstdFlags)
+	error_log = log.New(os.Stderr, "", log.LstdFlags)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "build":
+		os.Exit(build(os.Args[2:]))
+	case "inspect":
+		os.Exit(inspect(os.Args[2:]))
+	case "verify":
+		os.Exit(verify(os.Args[2:]))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
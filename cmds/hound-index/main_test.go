@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hound-search/hound/index"
+)
+
+func init() {
+	info_log = log.New(ioutil.Discard, "", 0)
+	error_log = log.New(ioutil.Discard, "", 0)
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, body := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildFromDir(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	out, err := ioutil.TempDir(os.TempDir(), "hound-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+
+	writeFiles(t, src, map[string]string{
+		"main.go":     "package main // HoundIndexNeedle\n",
+		".hidden.txt": "HoundIndexNeedle\n",
+	})
+
+	const url = "https://example.com/repo.git"
+	if status := build([]string{
+		"-dir", src,
+		"-url", url,
+		"-vcs", "local",
+		"-rev", "r1",
+		"-exclude-dot-files",
+		"-out", out,
+	}); status != 0 {
+		t.Fatalf("expected build to succeed, got status %d", status)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(out, "idx-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 {
+		t.Fatalf("expected 1 index, got %v", dirs)
+	}
+
+	// Read the index back the way houndd adopts one.
+	ref, err := index.Read(dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ref.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if ref.Url != url || ref.Rev != "r1" {
+		t.Fatalf("expected %s at r1, got %s at %s", url, ref.Url, ref.Rev)
+	}
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res, err := idx.Search("HoundIndexNeedle", &index.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 || res.Matches[0].Filename != "main.go" {
+		t.Fatalf("expected only main.go to match, got %+v", res.Matches)
+	}
+}
+
+// Flags for the settings of a repo are rejected when the settings come
+// from the config, rather than silently ignored.
+func TestBuildRejectsRepoFlagsWithConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hound-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(conf, []byte(`{
+		"dbpath": "db",
+		"repos": {
+			"repo": {"url": "https://example.com/repo.git"}
+		}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flag := range []string{"-exclude-dot-files", "-index-archives"} {
+		if status := build([]string{"-conf", conf, flag}); status != 2 {
+			t.Errorf("expected %s with -conf to fail with status 2, got %d", flag, status)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/blang/semver/v4"
 	"github.com/hound-search/hound/api"
@@ -22,7 +24,7 @@ import (
 	"github.com/hound-search/hound/web"
 )
 
-const gracefulShutdownSignal = syscall.SIGTERM
+var gracefulShutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
 
 var (
 	info_log   *log.Logger
@@ -31,17 +33,19 @@ var (
 	basepath   = filepath.Dir(b)
 )
 
-func makeSearchers(cfg *config.Config) (map[string]*searcher.Searcher, bool, error) {
+// Make the searchers for the repos in the config, along with the errors of
+// the repos that could not be indexed.
+func makeSearchers(cfg *config.Config) (map[string]*searcher.Searcher, map[string]error, error) {
 	// Ensure we have a dbpath
 	if _, err := os.Stat(cfg.DbPath); err != nil {
 		if err := os.MkdirAll(cfg.DbPath, os.ModePerm); err != nil {
-			return nil, false, err
+			return nil, nil, err
 		}
 	}
 
 	searchers, errs, err := searcher.MakeAll(cfg)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, err
 	}
 
 	if len(errs) > 0 {
@@ -50,17 +54,32 @@ func makeSearchers(cfg *config.Config) (map[string]*searcher.Searcher, bool, err
 		for name, _ := range errs { //nolint
 			delete(cfg.Repos, name)
 		}
-
-		return searchers, false, nil
 	}
 
-	return searchers, true, nil
+	return searchers, errs, nil
 }
 
-func handleShutdown(shutdownCh <-chan os.Signal, searchers map[string]*searcher.Searcher) {
+// On a shutdown signal, stop accepting connections and wait up to timeout
+// for in-flight requests before stopping the searchers and closing their
+// indexes. The returned channel is closed once shutdown is complete.
+func handleShutdown(
+	shutdownCh <-chan os.Signal,
+	ws *web.Server,
+	searchers map[string]*searcher.Searcher,
+	timeout time.Duration) <-chan struct{} {
+	doneCh := make(chan struct{})
 	go func() {
+		defer close(doneCh)
+
 		<-shutdownCh
 		info_log.Printf("Graceful shutdown requested...")
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := ws.Shutdown(ctx); err != nil {
+			error_log.Printf("Gave up waiting for requests to finish: %s", err)
+		}
+
 		for _, s := range searchers {
 			s.Stop()
 		}
@@ -69,13 +88,33 @@ func handleShutdown(shutdownCh <-chan os.Signal, searchers map[string]*searcher.
 			s.Wait()
 		}
 
-		os.Exit(0)
+		for name, s := range searchers {
+			if err := s.Close(); err != nil {
+				error_log.Printf("Failed to close index for %s: %s", name, err)
+			}
+		}
+	}()
+	return doneCh
+}
+
+// Reload the TLS certificate on SIGHUP, like after it has been renewed.
+func handleCertReload(ws *web.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := ws.ReloadCertificates(); err != nil {
+				error_log.Printf("Failed to reload TLS certificate: %s", err)
+			} else {
+				info_log.Println("Reloaded TLS certificate")
+			}
+		}
 	}()
 }
 
 func registerShutdownSignal() <-chan os.Signal {
 	shutdownCh := make(chan os.Signal, 1)
-	signal.Notify(shutdownCh, gracefulShutdownSignal)
+	signal.Notify(shutdownCh, gracefulShutdownSignals...)
 	return shutdownCh
 }
 
@@ -105,13 +144,13 @@ func runHttp( //nolint
 	idx map[string]*searcher.Searcher) error {
 	m := http.DefaultServeMux
 
-	h, err := ui.Content(dev, cfg)
+	h, err := ui.Content(dev, cfg, nil)
 	if err != nil {
 		return err
 	}
 
-	m.Handle("/", h)
-	api.Setup(m, idx, cfg.ResultLimit)
+	m.Handle(cfg.BasePath+"/", h)
+	api.Setup(m, idx, nil, nil, nil, cfg.Search, cfg.BasePath, cfg.ResultLimit)
 	return http.ListenAndServe(addr, m)
 }
 
@@ -133,6 +172,9 @@ func main() {
 	flagAddr := flag.String("addr", ":6080", "")
 	flagDev := flag.Bool("dev", false, "")
 	flagVer := flag.Bool("version", false, "Display version and exit")
+	flagTLSCert := flag.String("tls-cert", "", "Serve HTTPS with this certificate file, overrides the config")
+	flagTLSKey := flag.String("tls-key", "", "Key file for -tls-cert")
+	flagShutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests on shutdown")
 
 	flag.Parse()
 
@@ -146,23 +188,36 @@ func main() {
 		panic(err)
 	}
 
+	if *flagTLSCert != "" || *flagTLSKey != "" {
+		if cfg.TLS == nil {
+			cfg.TLS = &config.TLSConfig{}
+		}
+		cfg.TLS.CertFile = *flagTLSCert
+		cfg.TLS.KeyFile = *flagTLSKey
+	}
+
 	// Start the web server on a background routine.
-	ws := web.Start(&cfg, *flagAddr, *flagDev)
+	ws, err := web.Start(&cfg, *flagAddr, *flagDev)
+	if err != nil {
+		panic(err)
+	}
+
+	handleCertReload(ws)
 
 	// It's not safe to be killed during makeSearchers, so register the
 	// shutdown signal here and defer processing it until we are ready.
 	shutdownCh := registerShutdownSignal()
-	idx, ok, err := makeSearchers(&cfg)
+	idx, failed, err := makeSearchers(&cfg)
 	if err != nil {
 		log.Panic(err)
 	}
-	if !ok {
+	if len(failed) > 0 {
 		info_log.Println("Some repos failed to index, see output above")
 	} else {
 		info_log.Println("All indexes built!")
 	}
 
-	handleShutdown(shutdownCh, idx)
+	doneCh := handleShutdown(shutdownCh, ws, idx, *flagShutdownTimeout)
 
 	host := *flagAddr
 	if strings.HasPrefix(host, ":") { //nolint
@@ -181,8 +236,17 @@ func main() {
 		}
 	}
 
-	info_log.Printf("running server at http://%s\n", host)
+	scheme := "http"
+	if cfg.TLS != nil {
+		scheme = "https"
+	}
+	info_log.Printf("running server at %s://%s\n", scheme, host)
 
 	// Fully enable the web server now that we have indexes
-	panic(ws.ServeWithIndex(idx))
+	if err := ws.ServeWithIndex(idx, failed); err != http.ErrServerClosed {
+		panic(err)
+	}
+
+	<-doneCh
+	info_log.Println("Shutdown complete")
 }
@@ -67,6 +67,7 @@ package index
 import (
   "bytes"
   "encoding/binary"
+  "fmt"
   "log"
   "os"
   "runtime"
@@ -110,6 +111,54 @@ func Open(file string) *Index {
   return ix
 }
 
+// Check reports whether file looks like a complete index. Unlike Open, it
+// returns an error for a corrupt index rather than exiting.
+func Check(file string) error {
+  f, err := os.Open(file)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  fi, err := f.Stat()
+  if err != nil {
+    return err
+  }
+
+  size := fi.Size()
+  if size < int64(len(magic)+5*4+len(trailerMagic)) {
+    return fmt.Errorf("corrupt index: %s: too short", file)
+  }
+
+  head := make([]byte, len(magic))
+  if _, err := f.ReadAt(head, 0); err != nil {
+    return err
+  }
+  if string(head) != magic {
+    return fmt.Errorf("corrupt index: %s: bad header", file)
+  }
+
+  tail := make([]byte, 5*4+len(trailerMagic))
+  if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+    return err
+  }
+  if string(tail[5*4:]) != trailerMagic {
+    return fmt.Errorf("corrupt index: %s: bad trailer", file)
+  }
+
+  // the sections must appear in order and within the file.
+  prev := uint32(len(magic))
+  for i := 0; i < 5; i++ {
+    off := binary.BigEndian.Uint32(tail[4*i:])
+    if off < prev || int64(off) > size-int64(len(tail)) {
+      return fmt.Errorf("corrupt index: %s: bad section offset", file)
+    }
+    prev = off
+  }
+
+  return nil
+}
+
 // slice returns the slice of index data starting at the given byte offset.
 // If n >= 0, the slice must have length at least n and is truncated to length n.
 func (ix *Index) slice(off uint32, n int) []byte {
@@ -186,16 +235,43 @@ func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
 }
 
 func (ix *Index) dumpPosting() {  //nolint
-  d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
-  for i := 0; i < ix.numPost; i++ {
-    j := i * postEntrySize
-    t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
-    count := int(binary.BigEndian.Uint32(d[j+3:]))
-    offset := binary.BigEndian.Uint32(d[j+3+4:])
+  ix.eachList(func(t, count, offset uint32) {
     log.Printf("%#x: %d at %d", t, count, offset)
+  })
+}
+
+// eachList calls fn with each of the entries in the posting list index.
+func (ix *Index) eachList(fn func(trigram, count, offset uint32)) {
+  for i := 0; i < ix.numPost; i++ {
+    fn(ix.listAt(uint32(i * postEntrySize)))
   }
 }
 
+// NumNames returns the number of files in the index.
+func (ix *Index) NumNames() int {
+  return ix.numName
+}
+
+// NumTrigrams returns the number of distinct trigrams in the index, not
+// counting the "\xff\xff\xff" entry that terminates the posting lists.
+func (ix *Index) NumTrigrams() int {
+  if ix.numPost == 0 {
+    return 0
+  }
+  return ix.numPost - 1
+}
+
+// Trigrams calls fn with each trigram in the index, in order, along with
+// the number of files in its posting list.
+func (ix *Index) Trigrams(fn func(trigram uint32, count int)) {
+  ix.eachList(func(t, count, offset uint32) {
+    if t == 1<<24-1 {
+      return
+    }
+    fn(t, int(count))
+  })
+}
+
 func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
   // binary search
   d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
@@ -449,3 +525,18 @@ func File() string {
   }
   return home + "/.csearchindex"
 }
+
+// Mmap maps the named file into memory read-only. The returned function
+// unmaps it and closes the file.
+func Mmap(file string) ([]byte, func() error, error) {
+  f, err := os.Open(file)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  m := mmapFile(f)
+  if m.d == nil {
+    return nil, f.Close, nil
+  }
+  return m.d, m.close, nil
+}
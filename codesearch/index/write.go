@@ -272,6 +272,11 @@ func copyFile(dst, src *bufWriter) {
 	}
 }
 
+// NumNames returns the number of files added so far, which is the ID the next one gets.
+func (ix *IndexWriter) NumNames() int {
+	return ix.numName
+}
+
 // addName adds the file with the given name to the index.
 // It returns the assigned file ID number.
 func (ix *IndexWriter) addName(name string) uint32 {
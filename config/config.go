@@ -3,8 +3,10 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -17,7 +19,17 @@ const (
 	defaultBaseUrl               = "{url}/blob/{rev}/{path}{anchor}"
 	defaultAnchor                = "#L{line}"
 	defaultHealthCheckURI        = "/healthz"
+	defaultReadinessURI          = "/readyz"
 	defaultResultLimit           = 5000
+	defaultPeerTimeoutMs         = 5000
+	defaultProxyUserHeader       = "X-Forwarded-User"
+	defaultOIDCUserClaim         = "email"
+	defaultOIDCGroupsClaim       = "groups"
+	defaultOIDCSessionHours      = 12
+	defaultAuditLogMaxSizeMB     = 100
+	defaultAuditLogMaxFiles      = 5
+	defaultSearchQueueTimeoutMs  = 5000
+	defaultWebhookTimeoutMs      = 5000
 )
 
 type UrlPattern struct {
@@ -36,6 +48,10 @@ type Repo struct {
 	EnablePollUpdates  *bool          `json:"enable-poll-updates"`
 	EnablePushUpdates  *bool          `json:"enable-push-updates"`
 	AutoGeneratedFiles []string       `json:"auto-generated-files"`
+	IndexArchives      bool           `json:"index-archives"`
+	AllowedUsers       []string       `json:"allowed-users,omitempty"`
+	AllowedGroups      []string       `json:"allowed-groups,omitempty"`
+	ContentStore       string         `json:"content-store,omitempty"`
 }
 
 // Used for interpreting the config value for fields that use *bool. If a value
@@ -57,14 +73,141 @@ func (r *Repo) PushUpdatesEnabled() bool {
 	return optionToBool(r.EnablePushUpdates, defaultPushEnabled)
 }
 
+// Is this repo only visible to some users and groups?
+func (r *Repo) IsRestricted() bool {
+	return len(r.AllowedUsers) > 0 || len(r.AllowedGroups) > 0
+}
+
+// Public returns a copy of the repo as it is shown to API callers, peers
+// and the UI, without the users and groups allowed to see it or where its
+// content is stored on the server.
+func (r *Repo) Public() *Repo {
+	p := *r
+	p.AllowedUsers = nil
+	p.AllowedGroups = nil
+	p.ContentStore = ""
+	return &p
+}
+
+// A static token that grants API access to the given user.
+type AuthToken struct {
+	Token  string   `json:"token"`
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+}
+
+// Trust the identity in a header set by a reverse proxy, but only on
+// requests that come from one of the trusted networks.
+type ProxyHeaderAuth struct {
+	UserHeader   string   `json:"user-header"`
+	GroupsHeader string   `json:"groups-header"`
+	TrustedCIDRs []string `json:"trusted-cidrs"`
+}
+
+// Log users of the UI in with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client-id"`
+	ClientSecret string   `json:"client-secret"`
+	RedirectURL  string   `json:"redirect-url"`
+	Scopes       []string `json:"scopes"`
+	UserClaim    string   `json:"user-claim"`
+	GroupsClaim  string   `json:"groups-claim"`
+	CookieSecret string   `json:"cookie-secret"`
+	SessionHours int      `json:"session-hours"`
+}
+
+// The ways in which requests can be authenticated. If none are configured,
+// requests are not authenticated.
+type AuthConfig struct {
+	Tokens       []*AuthToken     `json:"tokens"`
+	HtpasswdFile string           `json:"htpasswd-file"`
+	ProxyHeader  *ProxyHeaderAuth `json:"proxy-header"`
+	OIDC         *OIDCConfig      `json:"oidc"`
+}
+
+// Serve HTTPS with the given certificate and key. If a client CA is given,
+// API requests must present a client certificate signed by it.
+type TLSConfig struct {
+	CertFile     string `json:"cert-file"`
+	KeyFile      string `json:"key-file"`
+	ClientCAFile string `json:"client-ca-file"`
+}
+
+// When set, the readiness check fails if more than MaxUnhealthyRepos repos
+// failed to index or update, or haven't been updated within StaleAfterMs.
+// MaxUnhealthyRepos must be given, so that leaving it out doesn't take the
+// server out of rotation as soon as a single repo fails.
+type ReadinessConfig struct {
+	MaxUnhealthyRepos *int `json:"max-unhealthy-repos"`
+	StaleAfterMs      int  `json:"stale-after-ms"`
+}
+
+// Record every search as a line of JSON in File. Searches that take longer
+// than SlowQueryMs are also written to SlowQueryFile along with the trigram
+// query used to find candidate files. Each file is rotated once it grows past
+// MaxSizeMB, keeping MaxFiles old copies.
+type AuditLogConfig struct {
+	File          string `json:"file"`
+	SlowQueryFile string `json:"slow-query-file"`
+	SlowQueryMs   int    `json:"slow-query-ms"`
+	MaxSizeMB     int    `json:"max-size-mb"`
+	MaxFiles      int    `json:"max-files"`
+}
+
+// Limits on how much searching is done at once. At most
+// MaxConcurrentSearches searches are run at a time, with up to
+// MaxQueuedSearches more waiting QueueTimeoutMs for their turn. Searches
+// beyond that are turned away. Across all searches, no more than Workers
+// repos are searched at a time. Up to CacheSizeMB of results are cached.
+type SearchConfig struct {
+	MaxConcurrentSearches int `json:"max-concurrent-searches"`
+	MaxQueuedSearches     int `json:"max-queued-searches"`
+	QueueTimeoutMs        int `json:"queue-timeout-ms"`
+	Workers               int `json:"workers"`
+	CacheSizeMB           int `json:"cache-size-mb"`
+}
+
+// Searches that are run again whenever a repo is reindexed. When their
+// results change, the matches that were added and removed are posted as
+// JSON to WebhookUrl, signed with Secret. The searches themselves are kept
+// in the dbpath.
+type SavedSearchConfig struct {
+	WebhookUrl string `json:"webhook-url"`
+	Secret     string `json:"secret"`
+	TimeoutMs  int    `json:"timeout-ms"`
+}
+
+// Separates the name of a peer from the names of its repos. Neither peers
+// nor local repos may use it in their names, so that the repos of peers
+// can't be mistaken for local ones.
+const PeerSeparator = ":"
+
+// Another Hound server whose repos are included in searches.
+type Peer struct {
+	Name        string            `json:"name"`
+	Host        string            `json:"host"`
+	HttpHeaders map[string]string `json:"http-headers"`
+	TimeoutMs   int               `json:"timeout-ms"`
+}
+
 type Config struct {
 	DbPath                string                    `json:"dbpath"`
 	Title                 string                    `json:"title"`
 	Repos                 map[string]*Repo          `json:"repos"`
 	MaxConcurrentIndexers int                       `json:"max-concurrent-indexers"`
 	HealthCheckURI        string                    `json:"health-check-uri"`
+	ReadinessURI          string                    `json:"readiness-uri"`
+	Readiness             *ReadinessConfig          `json:"readiness"`
 	VCSConfigMessages     map[string]*SecretMessage `json:"vcs-config"`
 	ResultLimit           int                       `json:"result-limit"`
+	Peers                 []*Peer                   `json:"peers"`
+	Auth                  *AuthConfig               `json:"auth"`
+	TLS                   *TLSConfig                `json:"tls"`
+	BasePath              string                    `json:"base-path"`
+	AuditLog              *AuditLogConfig           `json:"audit-log"`
+	Search                *SearchConfig             `json:"search"`
+	SavedSearches         *SavedSearchConfig        `json:"saved-searches"`
 }
 
 // SecretMessage is just like json.RawMessage but it will not
@@ -132,10 +275,95 @@ func initConfig(c *Config) error {
 		c.HealthCheckURI = defaultHealthCheckURI
 	}
 
+	if c.ReadinessURI == "" {
+		c.ReadinessURI = defaultReadinessURI
+	}
+
+	if c.Readiness != nil && c.Readiness.MaxUnhealthyRepos == nil {
+		return errors.New("readiness requires max-unhealthy-repos")
+	}
+
 	if c.ResultLimit == 0 {
 		c.ResultLimit = defaultResultLimit
 	}
 
+	// Normalize the base path to either be empty or to start, but not end,
+	// with a slash so that routes can be appended to it.
+	c.BasePath = strings.TrimRight(c.BasePath, "/")
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		c.BasePath = "/" + c.BasePath
+	}
+
+	if c.Auth != nil && c.Auth.ProxyHeader != nil {
+		if c.Auth.ProxyHeader.UserHeader == "" {
+			c.Auth.ProxyHeader.UserHeader = defaultProxyUserHeader
+		}
+	}
+
+	if c.Auth != nil {
+		for _, t := range c.Auth.Tokens {
+			if strings.TrimSpace(t.Token) == "" {
+				return fmt.Errorf("the auth token for user %q is empty", t.User)
+			}
+		}
+	}
+
+	if c.Auth != nil && c.Auth.OIDC != nil {
+		if err := initOIDC(c.Auth.OIDC); err != nil {
+			return err
+		}
+	}
+
+	if c.AuditLog != nil {
+		if c.AuditLog.MaxSizeMB <= 0 {
+			c.AuditLog.MaxSizeMB = defaultAuditLogMaxSizeMB
+		}
+
+		if c.AuditLog.MaxFiles <= 0 {
+			c.AuditLog.MaxFiles = defaultAuditLogMaxFiles
+		}
+	}
+
+	if c.Search != nil && c.Search.QueueTimeoutMs <= 0 {
+		c.Search.QueueTimeoutMs = defaultSearchQueueTimeoutMs
+	}
+
+	if c.SavedSearches != nil {
+		if c.SavedSearches.WebhookUrl == "" {
+			return errors.New("saved searches need a webhook-url")
+		}
+
+		if c.SavedSearches.Secret == "" {
+			return errors.New("saved searches need a secret to sign what is sent to the webhook-url")
+		}
+
+		if c.SavedSearches.TimeoutMs <= 0 {
+			c.SavedSearches.TimeoutMs = defaultWebhookTimeoutMs
+		}
+	}
+
+	if len(c.Peers) > 0 {
+		for name := range c.Repos {
+			if strings.Contains(name, PeerSeparator) {
+				return fmt.Errorf("the name of repo %q can't contain %q when there are peers", name, PeerSeparator)
+			}
+		}
+	}
+
+	for _, peer := range c.Peers {
+		if peer.Name == "" || peer.Host == "" {
+			return errors.New("peers must have both a name and a host")
+		}
+
+		if strings.Contains(peer.Name, PeerSeparator) {
+			return fmt.Errorf("the name of peer %q can't contain %q", peer.Name, PeerSeparator)
+		}
+
+		if peer.TimeoutMs == 0 {
+			peer.TimeoutMs = defaultPeerTimeoutMs
+		}
+	}
+
 	return mergeVCSConfigs(c)
 }
 
@@ -188,6 +416,38 @@ func mergeVCSConfigs(cfg *Config) error {
 	return nil
 }
 
+func initOIDC(o *OIDCConfig) error {
+	if o.Issuer == "" || o.ClientID == "" {
+		return errors.New("oidc requires both an issuer and a client-id")
+	}
+
+	if len(o.Scopes) == 0 {
+		o.Scopes = []string{"openid", "profile", "email"}
+	}
+
+	if o.UserClaim == "" {
+		o.UserClaim = defaultOIDCUserClaim
+	}
+
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = defaultOIDCGroupsClaim
+	}
+
+	if o.SessionHours <= 0 {
+		o.SessionHours = defaultOIDCSessionHours
+	}
+
+	return nil
+}
+
+// Resolve a path from the config file relative to the directory it is in.
+func relativeTo(filename, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(filename), path)
+}
+
 func (c *Config) LoadFromFile(filename string) error {
 	r, err := os.Open(filename)
 	if err != nil {
@@ -212,6 +472,21 @@ func (c *Config) LoadFromFile(filename string) error {
 		c.DbPath = path
 	}
 
+	if c.Auth != nil {
+		c.Auth.HtpasswdFile = relativeTo(filename, c.Auth.HtpasswdFile)
+	}
+
+	if c.TLS != nil {
+		c.TLS.CertFile = relativeTo(filename, c.TLS.CertFile)
+		c.TLS.KeyFile = relativeTo(filename, c.TLS.KeyFile)
+		c.TLS.ClientCAFile = relativeTo(filename, c.TLS.ClientCAFile)
+	}
+
+	if c.AuditLog != nil {
+		c.AuditLog.File = relativeTo(filename, c.AuditLog.File)
+		c.AuditLog.SlowQueryFile = relativeTo(filename, c.AuditLog.SlowQueryFile)
+	}
+
 	for _, repo := range c.Repos {
 		initRepo(repo)
 	}
@@ -57,3 +57,113 @@ func TestExampleConfigsAreValid(t *testing.T) {
 	}
 
 }
+
+func TestBasePathIsNormalized(t *testing.T) {
+	tests := map[string]string{
+		"":        "",
+		"/":       "",
+		"hound":   "/hound",
+		"/hound/": "/hound",
+		"/a/b":    "/a/b",
+	}
+
+	for v, expected := range tests {
+		cfg := Config{BasePath: v}
+		if err := initConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.BasePath != expected {
+			t.Errorf("base-path %q: expected %q, got %q", v, expected, cfg.BasePath)
+		}
+	}
+}
+
+func TestEmptyAuthTokensAreRejected(t *testing.T) {
+	cfg := Config{
+		Auth: &AuthConfig{
+			Tokens: []*AuthToken{
+				{Token: "s3cret", User: "ci"},
+				{Token: " ", User: "nobody"},
+			},
+		},
+	}
+	if err := initConfig(&cfg); err == nil {
+		t.Fatal("expected an error for an empty auth token")
+	}
+}
+
+func TestPublicRepoHidesAccessLists(t *testing.T) {
+	repo := &Repo{
+		Url:           "https://example.com/repo.git",
+		AllowedUsers:  []string{"alice"},
+		AllowedGroups: []string{"payments"},
+		ContentStore:  "/srv/hound/shared",
+	}
+
+	b, err := json.Marshal(repo.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"allowed-users", "allowed-groups", "content-store"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("expected %s to be left out, got %s", key, b)
+		}
+	}
+
+	if !repo.IsRestricted() {
+		t.Fatal("expected the repo itself to be left as it was")
+	}
+}
+
+func TestReadinessRequiresMaxUnhealthyRepos(t *testing.T) {
+	cfg := Config{Readiness: &ReadinessConfig{StaleAfterMs: 60000}}
+	if err := initConfig(&cfg); err == nil {
+		t.Fatal("expected an error without max-unhealthy-repos")
+	}
+
+	none := 0
+	cfg = Config{Readiness: &ReadinessConfig{MaxUnhealthyRepos: &none}}
+	if err := initConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerSeparatorIsRejectedInNames(t *testing.T) {
+	cfg := Config{
+		Repos: map[string]*Repo{"bu:api": {Url: "https://example.com/api.git"}},
+		Peers: []*Peer{{Name: "bu", Host: "https://hound.example.com"}},
+	}
+	if err := initConfig(&cfg); err == nil {
+		t.Fatal("expected an error for a repo that could be mistaken for a peer's")
+	}
+
+	cfg = Config{Peers: []*Peer{{Name: "b:u", Host: "https://hound.example.com"}}}
+	if err := initConfig(&cfg); err == nil {
+		t.Fatal("expected an error for a peer name with a separator")
+	}
+
+	cfg = Config{
+		Repos: map[string]*Repo{"org/api": {Url: "https://example.com/api.git"}},
+		Peers: []*Peer{{Name: "bu", Host: "https://hound.example.com"}},
+	}
+	if err := initConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSavedSearchesRequireASecret(t *testing.T) {
+	cfg := Config{SavedSearches: &SavedSearchConfig{WebhookUrl: "https://hooks.example.com/hound"}}
+	if err := initConfig(&cfg); err == nil {
+		t.Fatal("expected an error without a secret")
+	}
+
+	cfg.SavedSearches.Secret = "s3cret"
+	if err := initConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,259 @@
+package federation
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hound-search/hound/client"
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+)
+
+const (
+	// Separates the name of a peer from the name of one of its repos, as
+	// in payments:api for the api repo of the payments peer.
+	Separator = config.PeerSeparator
+
+	// How often the list of repos on each peer is refreshed.
+	reposRefreshInterval = 5 * time.Minute
+)
+
+// Peers forwards searches to other Hound servers and namespaces their repos
+// so that they can be merged with the local ones.
+type Peers struct {
+	peers []*config.Peer
+
+	lck   sync.RWMutex
+	repos map[string]map[string]*config.Repo
+}
+
+// The merged results of searching a set of peers. Peers that failed or
+// timed out are listed in Errors and their results are left out.
+type Result struct {
+	Results     map[string]*index.SearchResponse
+	FilesOpened int
+	Errors      map[string]string
+}
+
+type peerResult struct {
+	peer *config.Peer
+	res  *client.Response
+	err  error
+}
+
+type peerRepos struct {
+	peer  *config.Peer
+	repos map[string]*config.Repo
+	err   error
+}
+
+// Create the peers for the given config. The list of repos on each peer is
+// loaded in the background and kept up to date.
+func New(peers []*config.Peer) *Peers {
+	p := &Peers{
+		peers: peers,
+		repos: map[string]map[string]*config.Repo{},
+	}
+
+	if len(peers) > 0 {
+		go p.refreshRepos()
+	}
+
+	return p
+}
+
+func clientConfigFor(peer *config.Peer) *client.Config {
+	return &client.Config{
+		Host:        peer.Host,
+		HttpHeaders: peer.HttpHeaders,
+	}
+}
+
+func timeoutFor(peer *config.Peer) time.Duration {
+	return time.Duration(peer.TimeoutMs) * time.Millisecond
+}
+
+// Only ask peers for their own repos, this keeps peers that list each other
+// from forwarding requests back and forth.
+func localParams(params url.Values) url.Values {
+	v := url.Values{}
+	for key, val := range params {
+		v[key] = val
+	}
+	v.Set("local", "true")
+	return v
+}
+
+func loadRepos(peer *config.Peer) (map[string]*config.Repo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutFor(peer))
+	defer cancel()
+
+	repos := map[string]*config.Repo{}
+	if err := client.LoadReposWithParams(
+		ctx,
+		repos,
+		clientConfigFor(peer),
+		localParams(nil)); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// Reload the repos of every peer in parallel. A peer that can't be reached
+// keeps the repos it had before.
+func (p *Peers) loadAllRepos() {
+	ch := make(chan *peerRepos, len(p.peers))
+	for _, peer := range p.peers {
+		go func(peer *config.Peer) {
+			repos, err := loadRepos(peer)
+			ch <- &peerRepos{peer, repos, err}
+		}(peer)
+	}
+
+	for i := 0; i < len(p.peers); i++ {
+		r := <-ch
+		if r.err != nil {
+			log.Printf("failed to load repos from peer %s: %s", r.peer.Name, r.err)
+			continue
+		}
+
+		p.lck.Lock()
+		p.repos[r.peer.Name] = r.repos
+		p.lck.Unlock()
+	}
+}
+
+func (p *Peers) refreshRepos() {
+	for {
+		p.loadAllRepos()
+		time.Sleep(reposRefreshInterval)
+	}
+}
+
+// Repos returns the repos of all peers keyed by their namespaced names.
+// Repos that a peer lists as restricted are left out, as we can't tell who
+// is allowed to see them.
+func (p *Peers) Repos() map[string]*config.Repo {
+	p.lck.RLock()
+	defer p.lck.RUnlock()
+
+	res := map[string]*config.Repo{}
+	for name, repos := range p.repos {
+		for repo, data := range repos {
+			if data.IsRestricted() {
+				continue
+			}
+			res[name+Separator+repo] = data.Public()
+		}
+	}
+	return res
+}
+
+// Is the repo of the peer one that it lists as restricted? Peers only list
+// restricted repos to each other if they predate hiding them.
+func (p *Peers) isRestricted(peer, repo string) bool {
+	p.lck.RLock()
+	defer p.lck.RUnlock()
+
+	data := p.repos[peer][repo]
+	return data != nil && data.IsRestricted()
+}
+
+func (p *Peers) find(name string) *config.Peer {
+	for _, peer := range p.peers {
+		if peer.Name == name {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Select the peers and repos named by a list of repos in the same form as
+// the search API's repos parameter. Names that don't belong to a peer are
+// ignored and "*" selects every repo on every peer.
+func (p *Peers) Select(v string) map[*config.Peer][]string {
+	sel := map[*config.Peer][]string{}
+
+	v = strings.TrimSpace(v)
+	if v == "*" {
+		for _, peer := range p.peers {
+			sel[peer] = []string{"*"}
+		}
+		return sel
+	}
+
+	for _, name := range strings.Split(v, ",") {
+		ix := strings.Index(name, Separator)
+		if ix < 0 {
+			continue
+		}
+
+		peer := p.find(name[:ix])
+		if peer == nil {
+			continue
+		}
+		sel[peer] = append(sel[peer], name[ix+len(Separator):])
+	}
+	return sel
+}
+
+func search(peer *config.Peer, params url.Values) (*client.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutFor(peer))
+	defer cancel()
+
+	var res client.Response
+	if err := client.SearchWithParams(ctx, &res, clientConfigFor(peer), params); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Search forwards the search described by params to each of the selected
+// peers in parallel, asking each one for its selected repos. The results
+// are merged under the namespaced names of the repos.
+func (p *Peers) Search(params url.Values, sel map[*config.Peer][]string) *Result {
+	res := &Result{
+		Results: map[string]*index.SearchResponse{},
+	}
+
+	ch := make(chan *peerResult, len(sel))
+	for peer, repos := range sel {
+		v := localParams(params)
+		v.Set("repos", strings.Join(repos, ","))
+		v.Set("stats", "true")
+
+		go func(peer *config.Peer, v url.Values) {
+			r, err := search(peer, v)
+			ch <- &peerResult{peer, r, err}
+		}(peer, v)
+	}
+
+	for i := 0; i < len(sel); i++ {
+		r := <-ch
+		if r.err != nil {
+			log.Printf("search on peer %s failed: %s", r.peer.Name, r.err)
+			if res.Errors == nil {
+				res.Errors = map[string]string{}
+			}
+			res.Errors[r.peer.Name] = r.err.Error()
+			continue
+		}
+
+		for repo, sr := range r.res.Results {
+			if p.isRestricted(r.peer.Name, repo) {
+				continue
+			}
+			res.Results[r.peer.Name+Separator+repo] = sr
+		}
+
+		if r.res.Stats != nil {
+			res.FilesOpened += r.res.Stats.FilesOpened
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,151 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+// Start a fake Hound server that answers searches with a match in each of
+// the requested repos after the given delay.
+func startPeer(t *testing.T, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("local") != "true" {
+			t.Errorf("expected peer requests to be local, got %s", r.URL)
+		}
+
+		time.Sleep(delay)
+
+		switch r.URL.Path {
+		case "/api/v1/repos":
+			json.NewEncoder(w).Encode(map[string]*config.Repo{ //nolint
+				"api": {Url: "https://example.com/api.git"},
+			})
+		case "/api/v1/search":
+			res := map[string]interface{}{}
+			for _, repo := range []string{"api"} {
+				res[repo] = map[string]interface{}{
+					"Matches":        []interface{}{map[string]interface{}{"Filename": "main.go"}},
+					"FilesWithMatch": 1,
+					"Revision":       "abc",
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{ //nolint
+				"Results": res,
+				"Stats":   map[string]int{"FilesOpened": 3, "Duration": 1},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestSearchWithFailingPeer(t *testing.T) {
+	fast := startPeer(t, 0)
+	defer fast.Close()
+
+	slow := startPeer(t, 500*time.Millisecond)
+	defer slow.Close()
+
+	p := New(nil)
+	p.peers = []*config.Peer{
+		{Name: "fast", Host: fast.URL, TimeoutMs: 5000},
+		{Name: "slow", Host: slow.URL, TimeoutMs: 50},
+	}
+
+	sel := p.Select("*")
+	if len(sel) != 2 {
+		t.Fatalf("expected both peers to be selected, got %d", len(sel))
+	}
+
+	res := p.Search(url.Values{"q": {"foo"}}, sel)
+	if res.Results["fast:api"] == nil {
+		t.Fatalf("expected results for fast:api, got %v", res.Results)
+	}
+
+	if len(res.Results) != 1 {
+		t.Fatalf("expected results from one peer, got %v", res.Results)
+	}
+
+	if res.FilesOpened != 3 {
+		t.Fatalf("expected 3 files opened, got %d", res.FilesOpened)
+	}
+
+	if res.Errors["slow"] == "" {
+		t.Fatalf("expected an error for the slow peer, got %v", res.Errors)
+	}
+}
+
+func TestSelectAndRepos(t *testing.T) {
+	peer := startPeer(t, 0)
+	defer peer.Close()
+
+	p := New(nil)
+	p.peers = []*config.Peer{
+		{Name: "bu", Host: peer.URL, TimeoutMs: 5000},
+	}
+	p.loadAllRepos()
+
+	if repos := p.Repos(); repos["bu:api"] == nil || len(repos) != 1 {
+		t.Fatalf("expected the peer's repos to be namespaced, got %v", repos)
+	}
+
+	sel := p.Select("local,bu/api,bu:api,bu:web,unknown:api")
+	if len(sel) != 1 {
+		t.Fatalf("expected a single peer, got %d", len(sel))
+	}
+
+	for peer, repos := range sel {
+		if peer.Name != "bu" || len(repos) != 2 || repos[0] != "api" || repos[1] != "web" {
+			t.Fatalf("unexpected selection %s: %v", peer.Name, repos)
+		}
+	}
+}
+
+// Older peers list their restricted repos along with who may see them,
+// which can't be checked here, so neither the repos nor their results are
+// passed on.
+func TestRestrictedPeerReposAreHidden(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/repos":
+			json.NewEncoder(w).Encode(map[string]*config.Repo{ //nolint
+				"api":    {Url: "https://example.com/api.git"},
+				"secret": {Url: "https://example.com/secret.git", AllowedUsers: []string{"alice"}},
+			})
+		case "/api/v1/search":
+			res := map[string]interface{}{}
+			for _, repo := range []string{"api", "secret"} {
+				res[repo] = map[string]interface{}{
+					"Matches":  []interface{}{map[string]interface{}{"Filename": "main.go"}},
+					"Revision": "abc",
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Results": res}) //nolint
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer peer.Close()
+
+	p := New(nil)
+	p.peers = []*config.Peer{
+		{Name: "bu", Host: peer.URL, TimeoutMs: 5000},
+	}
+	p.loadAllRepos()
+
+	repos := p.Repos()
+	if repos["bu:api"] == nil || len(repos) != 1 {
+		t.Fatalf("expected only bu:api, got %v", repos)
+	}
+
+	res := p.Search(url.Values{"q": {"foo"}}, p.Select("*"))
+	if res.Results["bu:api"] == nil || len(res.Results) != 1 {
+		t.Fatalf("expected only results for bu:api, got %v", res.Results)
+	}
+}
@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/blang/semver/v4 v4.0.0
+	golang.org/x/crypto v0.8.0
 	golang.org/x/mod v0.10.0
 )
@@ -0,0 +1,244 @@
+package index
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hound-search/hound/codesearch/index"
+)
+
+// Separates the path of an archive from the path of a member within it,
+// as in lib/foo.jar!/META-INF/MANIFEST.MF.
+const archiveSeparator = "!/"
+
+const (
+	reasonBadArchive        = "Unable to read archive."
+	reasonTruncatedArchive  = "Unable to read all of archive, only the members before the error are indexed."
+	reasonBadArchiveMember  = "Invalid archive member path."
+	reasonDuplicateMember   = "Duplicate archive member."
+	reasonConflictingMember = "Archive member conflicts with a directory of another member."
+)
+
+// Is the given file a member of an archive rather than a file of the repo?
+func IsArchiveMember(name string) bool {
+	return strings.Contains(name, archiveSeparator)
+}
+
+// Is the given file an archive that we know how to open?
+func isArchive(name string) bool {
+	return archiveKind(name) != ""
+}
+
+func archiveKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"),
+		strings.HasSuffix(name, ".jar"),
+		strings.HasSuffix(name, ".war"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"),
+		strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	}
+	return ""
+}
+
+// Call fn for each regular file in the archive at filename. Member names
+// are reported exactly as they are recorded in the archive.
+func walkArchive(filename string, fn func(name string, r io.Reader) error) error {
+	switch archiveKind(filename) {
+	case "zip":
+		return walkZip(filename, fn)
+	case "tar":
+		return walkTar(filename, false, fn)
+	case "tgz":
+		return walkTar(filename, true, fn)
+	}
+	return nil
+}
+
+func walkZip(filename string, fn func(name string, r io.Reader) error) error {
+	z, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+
+	for _, f := range z.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		if err := func() error {
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			return fn(f.Name, r)
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(filename string, gzipped bool, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		g, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer g.Close()
+		r = g
+	}
+
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := fn(h.Name, t); err != nil {
+			return err
+		}
+	}
+}
+
+// Clean up the name of an archive member so that it can be safely used
+// in the content store. Returns false for names that would escape it.
+func cleanMemberName(name string) (string, bool) {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))[1:]
+	if name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// The paths of the members of an archive seen so far, which must not
+// clash with each other once they are written to the content store.
+type memberPaths struct {
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+// Record the member, returning the reason that it can't be indexed if it
+// repeats an earlier member, or if one of them would need to be both a
+// file and a directory, as with a and a/b.
+func (p *memberPaths) add(member string) string {
+	if p.files[member] {
+		return reasonDuplicateMember
+	}
+	if p.dirs[member] {
+		return reasonConflictingMember
+	}
+
+	for dir := path.Dir(member); dir != "."; dir = path.Dir(dir) {
+		if p.files[dir] {
+			return reasonConflictingMember
+		}
+	}
+
+	p.files[member] = true
+	for dir := path.Dir(member); dir != "."; dir = path.Dir(dir) {
+		p.dirs[dir] = true
+	}
+	return ""
+}
+
+// Index each of the text members of the archive at path under a virtual
+// path made up of the archive's relative path and the member name. Members
+// are subject to the same checks as regular files. Any members that are
+// excluded are returned along with their reasons.
+func addArchiveToIndex(ix *index.IndexWriter, cw contentWriter, meta *fileMetadata, src, path string) ([]*ExcludedFile, error) {
+	rel, err := filepath.Rel(src, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var excluded []*ExcludedFile
+	var errWrite error
+	seen := &memberPaths{
+		files: map[string]bool{},
+		dirs:  map[string]bool{},
+	}
+	indexed := 0
+	if err := walkArchive(path, func(name string, r io.Reader) error {
+		member, ok := cleanMemberName(name)
+		if !ok {
+			excluded = append(excluded, &ExcludedFile{rel + archiveSeparator + name, reasonBadArchiveMember})
+			return nil
+		}
+
+		vpath := rel + archiveSeparator + member
+
+		if reason := seen.add(member); reason != "" {
+			excluded = append(excluded, &ExcludedFile{vpath, reason})
+			return nil
+		}
+
+		br := bufio.NewReaderSize(r, filePeekSize)
+		buf, err := br.Peek(filePeekSize)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			excluded = append(excluded, &ExcludedFile{vpath, reasonReadError})
+			return err
+		}
+
+		if !isText(buf, len(buf) < filePeekSize) {
+			excluded = append(excluded, &ExcludedFile{vpath, reasonNotText})
+			return nil
+		}
+
+		reason, err := addToIndex(ix, cw, meta, vpath, br)
+		if err != nil {
+			errWrite = err
+			return err
+		}
+		if reason != "" {
+			excluded = append(excluded, &ExcludedFile{vpath, reason})
+		} else {
+			indexed++
+		}
+		return nil
+	}); err != nil {
+		// failures to write the index are fatal, but an archive that we
+		// can't read is treated like any other file that isn't indexable.
+		// The members that were read before the error stay indexed, so
+		// the archive is only partly excluded.
+		if errWrite != nil {
+			return nil, errWrite
+		}
+
+		reason := reasonBadArchive
+		if indexed > 0 {
+			reason = reasonTruncatedArchive
+		}
+		excluded = append(excluded, &ExcludedFile{rel, reason})
+	}
+
+	return excluded, nil
+}
@@ -0,0 +1,332 @@
+package index
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeZip(t *testing.T, filename string, files map[string]string) {
+	w, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	z := zip.NewWriter(w)
+	for name, body := range files {
+		f, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, filename string, files map[string]string) {
+	w, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	g := gzip.NewWriter(w)
+	tw := tar.NewWriter(g)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(body)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Write a tar with the members in order, which unlike a map can repeat
+// names.
+func writeTar(t *testing.T, filename string, members [][2]string) {
+	w, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tw := tar.NewWriter(w)
+	for _, m := range members {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     m[0],
+			Mode:     0644,
+			Size:     int64(len(m[1])),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readExcluded(t *testing.T, ref *IndexRef) map[string]string {
+	b, err := ioutil.ReadFile(filepath.Join(ref.Dir(), excludedFileJsonFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []*ExcludedFile
+	if err := json.Unmarshal(b, &files); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := map[string]string{}
+	for _, f := range files {
+		reasons[filepath.ToSlash(f.Filename)] = f.Reason
+	}
+	return reasons
+}
+
+func searchArchives(t *testing.T, src string) (*IndexRef, map[string]bool) {
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(&IndexOptions{IndexArchives: true}, dst, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res, err := idx.Search("HoundArchiveNeedle", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, m := range res.Matches {
+		found[filepath.ToSlash(m.Filename)] = true
+	}
+	return ref, found
+}
+
+func TestSearchInArchives(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	if err := os.Mkdir(filepath.Join(src, "lib"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	writeZip(t, filepath.Join(src, "lib", "foo.jar"), map[string]string{
+		"META-INF/MANIFEST.MF": "Main-Class: com.example.HoundArchiveNeedle\n",
+		"bin/data":             "\xff\xfe\x00binary",
+	})
+	writeTarGz(t, filepath.Join(src, "fixtures.tar.gz"), map[string]string{
+		"conf/app.yml": "needle: HoundArchiveNeedle\n",
+		"../escape":    "HoundArchiveNeedle\n",
+	})
+
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(&IndexOptions{IndexArchives: true}, dst, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res, err := idx.Search("HoundArchiveNeedle", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, m := range res.Matches {
+		found[filepath.ToSlash(m.Filename)] = true
+	}
+
+	for _, name := range []string{
+		"lib/foo.jar!/META-INF/MANIFEST.MF",
+		"fixtures.tar.gz!/conf/app.yml",
+		"fixtures.tar.gz!/escape",
+	} {
+		if !found[name] {
+			t.Errorf("expected a match in %s, got %v", name, found)
+		}
+	}
+
+	if len(found) != 3 {
+		t.Errorf("expected 3 matching files, got %v", found)
+	}
+}
+
+func TestArchivesNotIndexedByDefault(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeZip(t, filepath.Join(src, "foo.zip"), map[string]string{
+		"a.txt": "HoundArchiveNeedle\n",
+	})
+
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(&IndexOptions{}, dst, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res, err := idx.Search("HoundArchiveNeedle", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Matches) != 0 {
+		t.Fatalf("expected no matches, got %d", len(res.Matches))
+	}
+}
+
+// Members that can't be stored alongside the others are left out, without
+// failing the rest of the archive or the repo.
+func TestConflictingArchiveMembers(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	writeTar(t, filepath.Join(src, "members.tar"), [][2]string{
+		{"a", "HoundArchiveNeedle a\n"},
+		{"a/b", "HoundArchiveNeedle a/b\n"},
+		{"c/d", "HoundArchiveNeedle c/d\n"},
+		{"c", "HoundArchiveNeedle c\n"},
+		{"e", "HoundArchiveNeedle e\n"},
+		{"./e", "HoundArchiveNeedle e again\n"},
+	})
+	if err := ioutil.WriteFile(filepath.Join(src, "main.txt"), []byte("HoundArchiveNeedle\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, found := searchArchives(t, src)
+	defer ref.Remove() //nolint
+
+	expected := map[string]bool{
+		"main.txt":         true,
+		"members.tar!/a":   true,
+		"members.tar!/c/d": true,
+		"members.tar!/e":   true,
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected matches in %v, got %v", expected, found)
+	}
+
+	excluded := readExcluded(t, ref)
+	for name, reason := range map[string]string{
+		"members.tar!/a/b": reasonConflictingMember,
+		"members.tar!/c":   reasonConflictingMember,
+		"members.tar!/e":   reasonDuplicateMember,
+	} {
+		if excluded[name] != reason {
+			t.Errorf("expected %s to be excluded with %q, got %q", name, reason, excluded[name])
+		}
+	}
+	if _, ok := excluded["members.tar"]; ok {
+		t.Errorf("expected the archive itself to be indexed")
+	}
+}
+
+// The members read before an archive turns out to be truncated stay
+// indexed, and the archive is reported as only partly indexed.
+func TestTruncatedArchive(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	filename := filepath.Join(src, "truncated.tar")
+	writeTar(t, filename, [][2]string{
+		{"first.txt", "HoundArchiveNeedle first\n"},
+		{"second.txt", strings.Repeat("HoundArchiveNeedle second\n", 1000)},
+	})
+
+	// Cut the archive off part way through the body of the second member.
+	if err := os.Truncate(filename, 3*512+2000); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, found := searchArchives(t, src)
+	defer ref.Remove() //nolint
+
+	expected := map[string]bool{
+		"truncated.tar!/first.txt": true,
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected matches in %v, got %v", expected, found)
+	}
+
+	excluded := readExcluded(t, ref)
+	if r := excluded["truncated.tar!/second.txt"]; r != reasonReadError {
+		t.Errorf("expected the second member to be excluded with %q, got %q", reasonReadError, r)
+	}
+	if r := excluded["truncated.tar"]; r != reasonTruncatedArchive {
+		t.Errorf("expected the archive to be excluded with %q, got %q", reasonTruncatedArchive, r)
+	}
+}
@@ -0,0 +1,182 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The kinds of files that searches can leave out or rank below the rest,
+// as a set of bits.
+type FileClass uint8
+
+const (
+	// Third party code checked into the repo, like vendor/ or node_modules/.
+	ClassVendored FileClass = 1 << iota
+
+	// Minified JavaScript and CSS.
+	ClassMinified
+
+	// Files with a header saying that they were generated.
+	ClassGenerated
+
+	// Tests and their data.
+	ClassTest
+)
+
+var fileClassNames = []struct {
+	class FileClass
+	name  string
+}{
+	{ClassVendored, "vendored"},
+	{ClassMinified, "minified"},
+	{ClassGenerated, "generated"},
+	{ClassTest, "test"},
+}
+
+// The names of the classes in the set.
+func (c FileClass) Names() []string {
+	var names []string
+	for _, n := range fileClassNames {
+		if c&n.class != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// Parse a comma separated list of class names, like "vendored,test".
+func ParseFileClasses(s string) (FileClass, error) {
+	var c FileClass
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, n := range fileClassNames {
+			if strings.EqualFold(name, n.name) {
+				c |= n.class
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown kind of file %q", name)
+		}
+	}
+	return c, nil
+}
+
+// Directories whose contents are vendored.
+var vendoredDirs = map[string]bool{
+	"3rdparty":         true,
+	"Godeps":           true,
+	"bower_components": true,
+	"node_modules":     true,
+	"third_party":      true,
+	"thirdparty":       true,
+	"vendor":           true,
+	"vendors":          true,
+}
+
+// Directories whose contents are tests.
+var testDirs = map[string]bool{
+	"__tests__": true,
+	"spec":      true,
+	"test":      true,
+	"testdata":  true,
+	"tests":     true,
+}
+
+// Suffixes of the names of test files.
+var testSuffixes = []string{
+	"_test.go",
+	"_test.py",
+	"_test.rb",
+	"_spec.rb",
+	".test.js",
+	".test.jsx",
+	".test.ts",
+	".test.tsx",
+	".spec.js",
+	".spec.jsx",
+	".spec.ts",
+	".spec.tsx",
+	"Test.java",
+	"Tests.java",
+	"Test.kt",
+	"Tests.cs",
+	"Tests.swift",
+}
+
+// Files of these types are minified when their lines are this long on
+// average.
+var minifiable = map[string]bool{
+	".css": true,
+	".js":  true,
+	".mjs": true,
+}
+
+const minifiedLineLength = 110
+
+// Classify the file with the given name by its path and the header at the
+// start of head. The size and the number of lines in the file tell if it
+// is minified.
+func classify(name string, head []byte, size, lines int64) FileClass {
+	var c FileClass
+
+	// The members of archives are classified by their own paths, along with
+	// the path of the archive.
+	parts := strings.Split(strings.Replace(filepath.ToSlash(name), archiveSeparator, "/", -1), "/")
+	base := parts[len(parts)-1]
+	for _, dir := range parts[:len(parts)-1] {
+		if vendoredDirs[dir] {
+			c |= ClassVendored
+		}
+		if testDirs[dir] {
+			c |= ClassTest
+		}
+	}
+
+	if strings.HasPrefix(base, "test_") && strings.HasSuffix(base, ".py") {
+		c |= ClassTest
+	}
+	for _, suffix := range testSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			c |= ClassTest
+		}
+	}
+
+	ext := strings.ToLower(path.Ext(base))
+	if minifiable[ext] {
+		if strings.HasSuffix(strings.ToLower(base), ".min"+ext) || size/(lines+1) > minifiedLineLength {
+			c |= ClassMinified
+		}
+	}
+
+	if isGeneratedHeader(head) {
+		c |= ClassGenerated
+	}
+
+	return c
+}
+
+// Generated files say so in a comment near the top, like Go's "Code
+// generated by stringer; DO NOT EDIT." or "@generated".
+func isGeneratedHeader(head []byte) bool {
+	for _, line := range bytes.Split(head, []byte("\n")) {
+		if bytes.Contains(line, []byte("@generated")) {
+			return true
+		}
+
+		if i := bytes.Index(line, []byte("Code generated")); i >= 0 &&
+			bytes.Contains(line[i:], []byte("DO NOT EDIT")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	longLine := strings.Repeat("x", 500)
+
+	tests := []struct {
+		name  string
+		head  string
+		size  int64
+		lines int64
+		class FileClass
+	}{
+		{"main.go", "package main\n", 13, 1, 0},
+		{"vendor/github.com/x/y.go", "", 0, 0, ClassVendored},
+		{"web/node_modules/react/index.js", "", 0, 0, ClassVendored},
+		{"server_test.go", "", 0, 0, ClassTest},
+		{"tests/fixtures.json", "", 0, 0, ClassTest},
+		{"src/app.spec.ts", "", 0, 0, ClassTest},
+		{"test_views.py", "", 0, 0, ClassTest},
+		{"static/app.min.js", "", 10, 1, ClassMinified},
+		{"static/bundle.js", longLine, 500, 0, ClassMinified},
+		{"static/app.js", "", 500, 20, 0},
+		{"api.pb.go", "// Code generated by protoc-gen-go. DO NOT EDIT.\n", 0, 0, ClassGenerated},
+		{"Schema.java", "/*\n * @generated\n */\n", 0, 0, ClassGenerated},
+		{"lib/foo.jar!/vendor/a_test.go", "", 0, 0, ClassVendored | ClassTest},
+	}
+
+	for _, test := range tests {
+		if got := classify(test.name, []byte(test.head), test.size, test.lines); got != test.class {
+			t.Errorf("%s: expected %v, got %v", test.name, test.class.Names(), got.Names())
+		}
+	}
+}
+
+func TestParseFileClasses(t *testing.T) {
+	c, err := ParseFileClasses("vendored, Test,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != ClassVendored|ClassTest {
+		t.Errorf("unexpected classes: %v", c.Names())
+	}
+
+	if _, err := ParseFileClasses("vendored,docs"); err == nil {
+		t.Error("expected an unknown class to be rejected")
+	}
+}
+
+func TestExcludeAndDownRank(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a_test.go":    "package a // needle\n",
+		"b.go":         "package a // needle\n",
+		"gen.go":       "// Code generated by hand. DO NOT EDIT.\npackage a // needle\n",
+		"vendor/c.go":  "package c // needle\n",
+		"vendor/d.txt": "nothing here\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ref, err := Build(&IndexOptions{}, t.TempDir(), src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	filenames := func(opt *SearchOptions) []string {
+		res, err := idx.Search("needle", opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range res.Matches {
+			names = append(names, filepath.ToSlash(m.Filename))
+		}
+		return names
+	}
+
+	if got := filenames(&SearchOptions{Exclude: ClassVendored | ClassTest}); !reflect.DeepEqual(got, []string{"b.go", "gen.go"}) {
+		t.Errorf("unexpected files: %v", got)
+	}
+
+	if got := filenames(&SearchOptions{DownRank: ClassTest | ClassGenerated}); !reflect.DeepEqual(got, []string{"b.go", "vendor/c.go", "a_test.go", "gen.go"}) {
+		t.Errorf("unexpected order: %v", got)
+	}
+
+	// Down ranking happens before paging.
+	if got := filenames(&SearchOptions{DownRank: ClassVendored, Offset: 2, Limit: 2}); !reflect.DeepEqual(got, []string{"gen.go", "vendor/c.go"}) {
+		t.Errorf("unexpected page: %v", got)
+	}
+
+	res, err := idx.Search("needle", &SearchOptions{FileRegexp: "gen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := res.Matches[0]; !m.AutoGenerated || !reflect.DeepEqual(m.Classes, []string{"generated"}) {
+		t.Errorf("expected gen.go to be generated, got %+v", m)
+	}
+}
@@ -0,0 +1,541 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hound-search/hound/codesearch/index"
+)
+
+// The ways the contents of indexed files can be kept for grepping.
+const (
+	// Each file is gzipped on its own under raw/.
+	StoreFiles = "files"
+
+	// Files are packed together into a single file that is mmapped.
+	StorePacked = "packed"
+
+	// Like StorePacked, but each block of files is compressed.
+	StorePackedCompressed = "packed-compressed"
+)
+
+const (
+	packFilename      = "content.pack"
+	packIndexFilename = "content.idx"
+	packIndexMagic    = "hound content 1\n"
+
+	// Files are packed together until a block is at least this big, blocks
+	// are compressed as a whole.
+	packBlockSize = 64 << 10
+)
+
+// Keeps the contents of files as they are indexed.
+type contentWriter interface {
+	// Returns a writer for the content of name, which must be closed
+	// before the next file is added.
+	create(name string) (io.WriteCloser, error)
+	close() error
+}
+
+// Reads the contents of files for grepping.
+type contentReader interface {
+	// The content of name, which is only valid until the next read using
+	// the same grepper.
+	read(g *grepper, name string) ([]byte, error)
+	close() error
+}
+
+func isPacked(store string) bool {
+	return store == StorePacked || store == StorePackedCompressed
+}
+
+// Check that store is one that can be built.
+func validContentStore(store string) error {
+	switch store {
+	case "", StoreFiles, StorePacked, StorePackedCompressed, StoreShared:
+		return nil
+	}
+	return fmt.Errorf("unknown content store %q", store)
+}
+
+func newContentWriter(store, dst string) (contentWriter, error) {
+	if isPacked(store) {
+		return newPackWriter(dst, store == StorePackedCompressed)
+	}
+
+	if store == StoreShared {
+		return newSharedWriter(dst)
+	}
+
+	if err := os.Mkdir(filepath.Join(dst, "raw"), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &filesWriter{dir: filepath.Join(dst, "raw")}, nil
+}
+
+func openContent(store, dir string) (contentReader, error) {
+	if isPacked(store) {
+		return openPack(dir)
+	}
+
+	if store == StoreShared {
+		return openShared(dir)
+	}
+	return &filesReader{dir: filepath.Join(dir, "raw")}, nil
+}
+
+// Check that the content of the index in dir is all present.
+func checkContent(store, dir string) error {
+	if !isPacked(store) {
+		name := filepath.Join(dir, "raw")
+		if fi, err := os.Stat(name); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", name)
+		}
+
+		if store == StoreShared {
+			_, err := os.Stat(filepath.Join(dir, blobListFilename))
+			return err
+		}
+		return nil
+	}
+
+	p, err := openPack(dir)
+	if err != nil {
+		return err
+	}
+	return p.close()
+}
+
+// Gzips each file under dir.
+type filesWriter struct {
+	dir string
+}
+
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.f.Close()
+		return err
+	}
+	return g.f.Close()
+}
+
+func (w *filesWriter) create(name string) (io.WriteCloser, error) {
+	dup := filepath.Join(w.dir, name)
+	if err := os.MkdirAll(filepath.Dir(dup), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(dup)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gzipFile{gzip.NewWriter(f), f}, nil
+}
+
+func (w *filesWriter) close() error {
+	return nil
+}
+
+type filesReader struct {
+	dir string
+}
+
+func (r *filesReader) read(g *grepper, name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return g.fillFrom(c)
+}
+
+func (r *filesReader) close() error {
+	return nil
+}
+
+// The pack is a sequence of blocks, each holding the contents of one or
+// more files back to back. The pack index has the form:
+//
+//	"hound content 1\n"
+//	compressed [1]
+//	block count [4]
+//	file count [4]
+//	blocks: offset [8], stored length [4], length [4]
+//	files, sorted by name: name offset [4], block [4], offset [4], length [4]
+//	names, each followed by a NUL
+//
+// Numbers are big-endian. Files are found by a binary search on their
+// names.
+const (
+	packBlockEntrySize = 8 + 4 + 4
+	packFileEntrySize  = 4 + 4 + 4 + 4
+)
+
+type packBlock struct {
+	offset uint64
+	stored uint32
+	length uint32
+}
+
+type packFile struct {
+	name   string
+	block  uint32
+	offset uint32
+	length uint32
+}
+
+type packWriter struct {
+	dir      string
+	compress bool
+
+	f      *os.File
+	offset uint64
+	blocks []packBlock
+	files  []packFile
+
+	// the block being filled and the file being added to it.
+	buf   bytes.Buffer
+	cur   *packFile
+	zbuf  bytes.Buffer
+	flate *flate.Writer
+}
+
+func newPackWriter(dir string, compress bool) (*packWriter, error) {
+	f, err := os.Create(filepath.Join(dir, packFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	w := &packWriter{
+		dir:      dir,
+		compress: compress,
+		f:        f,
+	}
+
+	if compress {
+		w.flate, err = flate.NewWriter(&w.zbuf, flate.DefaultCompression)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+func (w *packWriter) create(name string) (io.WriteCloser, error) {
+	w.cur = &packFile{
+		name:   name,
+		block:  uint32(len(w.blocks)),
+		offset: uint32(w.buf.Len()),
+	}
+	return w, nil
+}
+
+func (w *packWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// Finish the file being added, starting a new block once this one is full.
+func (w *packWriter) Close() error {
+	w.cur.length = uint32(w.buf.Len()) - w.cur.offset
+	w.files = append(w.files, *w.cur)
+	w.cur = nil
+
+	if w.buf.Len() >= packBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *packWriter) flushBlock() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	data := w.buf.Bytes()
+	if w.compress {
+		w.zbuf.Reset()
+		w.flate.Reset(&w.zbuf)
+		if _, err := w.flate.Write(data); err != nil {
+			return err
+		}
+		if err := w.flate.Close(); err != nil {
+			return err
+		}
+		data = w.zbuf.Bytes()
+	}
+
+	if _, err := w.f.Write(data); err != nil {
+		return err
+	}
+
+	w.blocks = append(w.blocks, packBlock{
+		offset: w.offset,
+		stored: uint32(len(data)),
+		length: uint32(w.buf.Len()),
+	})
+	w.offset += uint64(len(data))
+	w.buf.Reset()
+	return nil
+}
+
+func (w *packWriter) writeIndex() error {
+	f, err := os.Create(filepath.Join(w.dir, packIndexFilename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sort.Slice(w.files, func(i, j int) bool {
+		return w.files[i].name < w.files[j].name
+	})
+
+	b := bufio.NewWriter(f)
+	b.WriteString(packIndexMagic) //nolint
+	if w.compress {
+		b.WriteByte(1) //nolint
+	} else {
+		b.WriteByte(0) //nolint
+	}
+
+	var u4 [4]byte
+	var u8 [8]byte
+	put4 := func(v uint32) {
+		binary.BigEndian.PutUint32(u4[:], v)
+		b.Write(u4[:]) //nolint
+	}
+
+	put4(uint32(len(w.blocks)))
+	put4(uint32(len(w.files)))
+	for _, blk := range w.blocks {
+		binary.BigEndian.PutUint64(u8[:], blk.offset)
+		b.Write(u8[:]) //nolint
+		put4(blk.stored)
+		put4(blk.length)
+	}
+
+	var nameOff uint32
+	for _, file := range w.files {
+		put4(nameOff)
+		put4(file.block)
+		put4(file.offset)
+		put4(file.length)
+		nameOff += uint32(len(file.name) + 1)
+	}
+
+	for _, file := range w.files {
+		b.WriteString(file.name) //nolint
+		b.WriteByte(0)           //nolint
+	}
+
+	// bufio.Writer keeps the first error, so it is reported here.
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (w *packWriter) close() error {
+	if err := w.flushBlock(); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	return w.writeIndex()
+}
+
+var errCorruptPack = errors.New("corrupt content pack")
+
+// The pack and its index, both mmapped.
+type packReader struct {
+	compressed bool
+	numBlocks  int
+	numFiles   int
+	blocks     []byte
+	files      []byte
+	names      []byte
+
+	data       []byte
+	closeData  func() error
+	closeIndex func() error
+}
+
+func openPack(dir string) (*packReader, error) {
+	idx, closeIndex, err := index.Mmap(filepath.Join(dir, packIndexFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	data, closeData, err := index.Mmap(filepath.Join(dir, packFilename))
+	if err != nil {
+		closeIndex()
+		return nil, err
+	}
+
+	p := &packReader{
+		data:       data,
+		closeData:  closeData,
+		closeIndex: closeIndex,
+	}
+
+	if err := p.parseIndex(idx); err != nil {
+		p.close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *packReader) parseIndex(idx []byte) error {
+	head := len(packIndexMagic) + 1 + 4 + 4
+	if len(idx) < head || string(idx[:len(packIndexMagic)]) != packIndexMagic {
+		return errCorruptPack
+	}
+
+	p.compressed = idx[len(packIndexMagic)] == 1
+	p.numBlocks = int(binary.BigEndian.Uint32(idx[len(packIndexMagic)+1:]))
+	p.numFiles = int(binary.BigEndian.Uint32(idx[len(packIndexMagic)+5:]))
+
+	filesAt := head + p.numBlocks*packBlockEntrySize
+	namesAt := filesAt + p.numFiles*packFileEntrySize
+	if namesAt > len(idx) {
+		return errCorruptPack
+	}
+
+	p.blocks = idx[head:filesAt]
+	p.files = idx[filesAt:namesAt]
+	p.names = idx[namesAt:]
+
+	// every block must be within the pack.
+	size := uint64(len(p.data))
+	for i := 0; i < p.numBlocks; i++ {
+		blk := p.block(i)
+		if blk.offset > size || uint64(blk.stored) > size-blk.offset {
+			return errCorruptPack
+		}
+	}
+
+	return nil
+}
+
+func (p *packReader) block(i int) packBlock {
+	b := p.blocks[i*packBlockEntrySize:]
+	return packBlock{
+		offset: binary.BigEndian.Uint64(b),
+		stored: binary.BigEndian.Uint32(b[8:]),
+		length: binary.BigEndian.Uint32(b[12:]),
+	}
+}
+
+func (p *packReader) file(i int) (name []byte, f packFile) {
+	b := p.files[i*packFileEntrySize:]
+	off := int(binary.BigEndian.Uint32(b))
+	if off < len(p.names) {
+		name = p.names[off:]
+		if n := bytes.IndexByte(name, 0); n >= 0 {
+			name = name[:n]
+		}
+	}
+
+	return name, packFile{
+		block:  binary.BigEndian.Uint32(b[4:]),
+		offset: binary.BigEndian.Uint32(b[8:]),
+		length: binary.BigEndian.Uint32(b[12:]),
+	}
+}
+
+// The decompressed content of block i, reusing the one held by the grepper
+// if it is the same block.
+func (p *packReader) blockData(g *grepper, i int) ([]byte, error) {
+	blk := p.block(i)
+	stored := p.data[blk.offset : blk.offset+uint64(blk.stored)]
+	if !p.compressed {
+		return stored, nil
+	}
+
+	if g.pack == p && g.packBlock == i {
+		return g.buf[:blk.length], nil
+	}
+
+	if cap(g.buf) < int(blk.length) {
+		g.buf = make([]byte, blk.length)
+	}
+	buf := g.buf[:blk.length]
+
+	// forget the cached block in case this fails part way through.
+	g.pack = nil
+	r := flate.NewReader(bytes.NewReader(stored))
+	defer r.Close()
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	g.pack, g.packBlock = p, i
+	return buf, nil
+}
+
+func (p *packReader) read(g *grepper, name string) ([]byte, error) {
+	i := sort.Search(p.numFiles, func(i int) bool {
+		n, _ := p.file(i)
+		return string(n) >= name
+	})
+	if i == p.numFiles {
+		return nil, fmt.Errorf("%s is not in the content pack", name)
+	}
+
+	n, f := p.file(i)
+	if string(n) != name {
+		return nil, fmt.Errorf("%s is not in the content pack", name)
+	}
+
+	if int(f.block) >= p.numBlocks {
+		return nil, errCorruptPack
+	}
+
+	data, err := p.blockData(g, int(f.block))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(f.offset)+uint64(f.length) > uint64(len(data)) {
+		return nil, errCorruptPack
+	}
+	return data[f.offset : f.offset+f.length], nil
+}
+
+func (p *packReader) close() error {
+	err := p.closeData()
+	if e := p.closeIndex(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
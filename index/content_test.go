@@ -0,0 +1,374 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var contentStores = []string{StoreFiles, StorePacked, StorePackedCompressed}
+
+func buildIndexWithStore(t testing.TB, src, store string) *IndexRef {
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := Build(&IndexOptions{ContentStore: store}, dst, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// Every content store gives the same search results.
+func TestContentStores(t *testing.T) {
+	var expected *SearchResponse
+	for _, store := range contentStores {
+		ref := buildIndexWithStore(t, thisDir(), store)
+		defer ref.Remove() //nolint
+
+		ref, err := Read(ref.Dir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.ContentStore != store {
+			t.Fatalf("expected the manifest to record %s, got %s", store, ref.ContentStore)
+		}
+
+		if errs, err := Verify(ref.Dir()); err != nil || len(errs) != 0 {
+			t.Fatalf("%s: expected a clean index, got %v %v", store, errs, err)
+		}
+
+		idx, err := Open(ref.Dir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+
+		res, err := idx.Search("func|8365a", &SearchOptions{LinesOfContext: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Duration = 0
+		if len(res.Matches) == 0 {
+			t.Fatalf("%s: expected matches", store)
+		}
+
+		if expected == nil {
+			expected = res
+		} else if !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: expected the same results as %s", store, contentStores[0])
+		}
+	}
+}
+
+func TestCorruptContentPack(t *testing.T) {
+	ref := buildIndexWithStore(t, thisDir(), StorePacked)
+	defer ref.Remove() //nolint
+
+	if err := ref.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the pack short so that its blocks no longer fit.
+	name := filepath.Join(ref.Dir(), packFilename)
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, fi.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ref.Validate(); err == nil {
+		t.Fatal("expected a truncated pack to be invalid")
+	}
+
+	if err := os.Remove(filepath.Join(ref.Dir(), packIndexFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ref.Validate(); err == nil {
+		t.Fatal("expected a missing pack index to be invalid")
+	}
+}
+
+func TestCorruptContentPackBlock(t *testing.T) {
+	ref := buildIndexWithStore(t, thisDir(), StorePacked)
+	defer ref.Remove() //nolint
+
+	name := filepath.Join(ref.Dir(), packIndexFilename)
+	idx, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head := len(packIndexMagic) + 1 + 4 + 4
+	blocks := int(binary.BigEndian.Uint32(idx[len(packIndexMagic)+1:]))
+	if blocks < 3 {
+		t.Fatalf("expected a few blocks, got %d", blocks)
+	}
+
+	// Move a block in the middle past the end of the pack, the last one
+	// still fits.
+	mid := idx[head+blocks/2*packBlockEntrySize:]
+	binary.BigEndian.PutUint64(mid, 1<<40)
+	if err := ioutil.WriteFile(name, idx, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ref.Validate(); err == nil {
+		t.Fatal("expected a block outside of the pack to be invalid")
+	}
+}
+
+func TestUnknownContentStore(t *testing.T) {
+	dst, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if _, err := Build(&IndexOptions{ContentStore: "tape"}, dst, thisDir(), url, rev); err == nil {
+		t.Fatal("expected an unknown content store to be rejected")
+	}
+}
+
+// Write a tree of small source files to search.
+func makeCorpus(b *testing.B, files int) string {
+	dir := b.TempDir()
+	for i := 0; i < files; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("pkg%d", i%50))
+		if err := os.MkdirAll(sub, os.ModePerm); err != nil {
+			b.Fatal(err)
+		}
+
+		var src []byte
+		for j := 0; j < 40; j++ {
+			src = append(src, fmt.Sprintf("func handler%d_%d(w Writer, r *Request) error {\n\treturn nil // %d\n}\n", i, j, i*j)...)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("file%d.go", i)), src, 0600); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func BenchmarkContentStores(b *testing.B) {
+	src := makeCorpus(b, 2000)
+
+	for _, store := range contentStores {
+		b.Run("build/"+store, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ref := buildIndexWithStore(b, src, store)
+				ref.Remove() //nolint
+			}
+		})
+
+		ref := buildIndexWithStore(b, src, store)
+		idx, err := ref.Open()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// A pattern that every file matches, so they are all read.
+		b.Run("search/"+store, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := idx.Search(`Request\) error`, &SearchOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		idx.Close()
+		ref.Remove() //nolint
+	}
+}
+
+// Indexes in the shared store link the same content to one blob, which
+// stays around until the last index using it is removed.
+func TestSharedContent(t *testing.T) {
+	db := t.TempDir()
+	build := func(name string) *IndexRef {
+		dst := filepath.Join(db, name)
+		if err := os.Mkdir(dst, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		ref, err := Build(&IndexOptions{ContentStore: StoreShared}, dst, thisDir(), url, rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+
+	a := build("idx-a")
+	b := build("idx-b")
+
+	if errs, err := Verify(a.Dir()); err != nil || len(errs) != 0 {
+		t.Fatalf("expected a clean index, got %v %v", errs, err)
+	}
+
+	blobs, err := ioutil.ReadDir(filepath.Join(db, blobsDirname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) == 0 {
+		t.Fatal("expected shared blobs")
+	}
+	for _, fi := range blobs {
+		if n, ok := linkCount(fi); ok && n < 3 {
+			t.Fatalf("expected %s to be linked from both indexes, has %d links", fi.Name(), n)
+		}
+	}
+
+	idx, err := b.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := idx.Search("func TestSharedContent", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 || res.Matches[0].ContentHash == "" {
+		t.Fatalf("expected a match with a content hash, got %v", res.Matches)
+	}
+	hash := res.Matches[0].ContentHash
+	if !idx.HasContent(hash) || idx.HasContent("00") {
+		t.Fatal("expected the index to have only the content it matched")
+	}
+	idx.Close()
+
+	// The blobs are still used by b.
+	if err := a.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(db, blobsDirname, hash)); err != nil {
+		t.Fatalf("expected the blob to be kept for the other index: %s", err)
+	}
+
+	if err := b.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err = ioutil.ReadDir(filepath.Join(db, blobsDirname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 0 {
+		t.Fatalf("expected unused blobs to be removed, %d are left", len(blobs))
+	}
+}
+
+// Writing a name again replaces its content in raw/.
+func TestSharedContentRewrite(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "idx-a")
+	if err := os.Mkdir(dst, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newSharedWriter(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		f, err := w.create("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("failed to write %s: %s", content, err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openShared(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	var g grepper
+	buf, err := r.read(&g, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "second" {
+		t.Fatalf("expected the second content, got %q", buf)
+	}
+}
+
+// Temporary files left by builds that didn't finish and blobs that no index
+// lists are swept away, the rest are kept.
+func TestSweepShared(t *testing.T) {
+	db := t.TempDir()
+	dst := filepath.Join(db, "idx-a")
+	if err := os.Mkdir(dst, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := Build(&IndexOptions{ContentStore: StoreShared}, dst, thisDir(), url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := filepath.Join(db, blobsDirname)
+	before, err := ioutil.ReadDir(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, age time.Duration) string {
+		path := filepath.Join(blobs, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(-age)
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	stale := write(blobTmpPrefix+"stale", 2*staleTmpAge)
+	fresh := write(blobTmpPrefix+"fresh", 0)
+	unused := write(strings.Repeat("ab", 32), 0)
+
+	if err := SweepShared(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{stale, unused} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("expected a temporary file that may be in use to be kept: %s", err)
+	}
+
+	after, err := ioutil.ReadDir(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatalf("expected the %d blobs in use to be kept, %d files are left", len(before), len(after))
+	}
+	if errs, err := Verify(ref.Dir()); err != nil || len(errs) != 0 {
+		t.Fatalf("expected a clean index, got %v %v", errs, err)
+	}
+
+	// Without any shared content there's nothing to do.
+	if err := SweepShared(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,6 +13,10 @@ var nl = []byte{'\n'}
 
 type grepper struct {
 	buf []byte
+
+	// The content pack block held in buf, if any.
+	pack      *packReader
+	packBlock int
 }
 
 func countLines(b []byte) int {
@@ -45,24 +49,8 @@ func (g *grepper) grepFile(filename string, re *regexp.Regexp,  //nolint
 	return g.grep(c, re, fn)
 }
 
-func (g *grepper) grep2File(filename string, re *regexp.Regexp, nctx int,
-	fn func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error)) error {
-	r, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-
-	c, err := gzip.NewReader(r)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	return g.grep2(c, re, nctx, fn)
-}
-
 func (g *grepper) fillFrom(r io.Reader) ([]byte, error) {
+	g.pack = nil
 	if g.buf == nil {
 		g.buf = make([]byte, 1<<20)
 	}
@@ -142,6 +130,15 @@ func (g *grepper) grep2(
 		return err
 	}
 
+	return grep2Buf(buf, re, nctx, fn)
+}
+
+// Like grep2, but for content that is already in memory.
+func grep2Buf(
+	buf []byte,
+	re *regexp.Regexp,
+	nctx int,
+	fn func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error)) error {
 	lineno := 0
 	for {
 		if len(buf) == 0 {
@@ -247,6 +244,4 @@ func (g *grepper) grep(r io.Reader, re *regexp.Regexp, fn func(line []byte, line
 			return nil
 		}
 	}
-
-	return nil  //nolint
 }
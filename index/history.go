@@ -0,0 +1,222 @@
+package index
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hound-search/hound/codesearch/regexp"
+)
+
+// The kinds of search that SearchOptions.Type selects between. The
+// history of a repo is only searched when its index was built with one.
+const (
+	SearchFiles   = ""
+	SearchDiffs   = "diff"
+	SearchCommits = "commit"
+)
+
+const historyFilename = "history.json.gz"
+
+// A commit along with the lines that it added and removed. In search
+// results, Files only has the hunks that matched and is empty for
+// searches of commit messages.
+type Commit struct {
+	Hash    string
+	Author  string
+	Date    time.Time
+	Message string
+	Files   []*FileDiff `json:",omitempty"`
+}
+
+// The hunks of a commit that changed the file at Path.
+type FileDiff struct {
+	Path  string
+	Hunks []*Hunk
+}
+
+// The added and removed lines of a hunk, each starting with a + or a -.
+// Header is the hunk's @@ line.
+type Hunk struct {
+	Header string
+	Lines  []string
+}
+
+func writeHistory(dst string, commits []*Commit) error {
+	w, err := os.Create(filepath.Join(dst, historyFilename))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(commits); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func readHistory(dir string) ([]*Commit, error) {
+	r, err := os.Open(filepath.Join(dir, historyFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []*Commit
+	if err := json.NewDecoder(gz).Decode(&commits); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %s", filepath.Join(dir, historyFilename), err)
+	}
+	return commits, nil
+}
+
+func matchesAny(re *regexp.Regexp, lines ...string) bool {
+	for _, line := range lines {
+		if re.MatchString(line, true, true) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// The commit if its author or message matches, or nil.
+func matchCommit(c *Commit, re *regexp.Regexp) *Commit {
+	if !matchesAny(re, c.Author) && !matchesAny(re, strings.Split(c.Message, "\n")...) {
+		return nil
+	}
+
+	m := *c
+	m.Files = nil
+	return &m
+}
+
+// A copy of the commit with only the hunks that have a matching line, or
+// nil if there are none.
+func matchDiff(c *Commit, re, fre, excludeFre *regexp.Regexp, opt *SearchOptions) *Commit {
+	var files []*FileDiff
+	for _, f := range c.Files {
+		if fre != nil && fre.MatchString(f.Path, true, true) < 0 {
+			continue
+		}
+
+		if excludeFre != nil && excludeFre.MatchString(f.Path, true, true) > 0 {
+			continue
+		}
+
+		// The contents of the file aren't kept, so only its name is used.
+		if opt.Language != "" && !strings.EqualFold(languageFor(f.Path, nil), opt.Language) {
+			continue
+		}
+
+		if classify(f.Path, nil, 0, 0)&opt.Exclude != 0 {
+			continue
+		}
+
+		var hunks []*Hunk
+		for _, h := range f.Hunks {
+			for _, line := range h.Lines {
+				// The + or - isn't part of the line.
+				if re.MatchString(line[1:], true, true) >= 0 {
+					hunks = append(hunks, h)
+					break
+				}
+			}
+		}
+
+		if hunks != nil {
+			files = append(files, &FileDiff{Path: f.Path, Hunks: hunks})
+		}
+	}
+
+	if files == nil {
+		return nil
+	}
+
+	m := *c
+	m.Files = files
+	return &m
+}
+
+// Read the history the first time it is needed, so that indexes that are
+// never searched this way don't hold it in memory.
+func (n *Index) loadHistory() ([]*Commit, error) {
+	n.historyOnce.Do(func() {
+		if n.Ref.HistoryCommits > 0 {
+			n.history, n.historyErr = readHistory(n.Ref.dir)
+		}
+	})
+	return n.history, n.historyErr
+}
+
+// Search the commits of the index's history. Offset, Limit and MaxResults
+// count commits rather than files or lines.
+func (n *Index) searchHistory(pat string, opt *SearchOptions) (*SearchResponse, error) {
+	startedAt := time.Now()
+
+	if opt.Type != SearchDiffs && opt.Type != SearchCommits {
+		return nil, fmt.Errorf("unknown search type %q", opt.Type)
+	}
+
+	n.lck.RLock()
+	defer n.lck.RUnlock()
+
+	re, err := compilePattern(pat, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	fre, excludeFre, err := compileFileRegexps(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := n.loadHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results []*Commit
+		found   int
+	)
+	for _, c := range history {
+		var m *Commit
+		if opt.Type == SearchCommits {
+			m = matchCommit(c, re)
+		} else {
+			m = matchDiff(c, re, fre, excludeFre, opt)
+		}
+
+		if m == nil {
+			continue
+		}
+
+		found++
+		if found <= opt.Offset ||
+			(opt.Limit > 0 && len(results) >= opt.Limit) ||
+			(opt.MaxResults > 0 && len(results) >= opt.MaxResults) {
+			continue
+		}
+		results = append(results, m)
+	}
+
+	return &SearchResponse{
+		Commits:        results,
+		FilesWithMatch: found,
+		Duration:       time.Since(startedAt),
+		Revision:       n.Ref.Rev,
+	}, nil
+}
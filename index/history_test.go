@@ -0,0 +1,180 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testHistory = []*Commit{
+	{
+		Hash:    "c3",
+		Author:  "Ann <ann@example.com>",
+		Date:    time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC),
+		Message: "Drop the legacy client\n\nNothing uses it anymore.",
+		Files: []*FileDiff{
+			{
+				Path: "client/legacy.go",
+				Hunks: []*Hunk{
+					{Header: "@@ -1,2 +0,0 @@", Lines: []string{"-package client", "-func Dial() {}"}},
+				},
+			},
+			{
+				Path: "main.go",
+				Hunks: []*Hunk{
+					{Header: "@@ -3 +3 @@", Lines: []string{"-\tclient.Dial()", "+\tserver.Run()"}},
+					{Header: "@@ -9 +9 @@", Lines: []string{"-// TODO", "+// done"}},
+				},
+			},
+		},
+	},
+	{
+		Hash:    "c2",
+		Author:  "Bob <bob@example.com>",
+		Date:    time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC),
+		Message: "Add the legacy client",
+		Files: []*FileDiff{
+			{
+				Path: "client/legacy.go",
+				Hunks: []*Hunk{
+					{Header: "@@ -0,0 +1,2 @@", Lines: []string{"+package client", "+func Dial() {}"}},
+				},
+			},
+		},
+	},
+	{
+		Hash:    "c1",
+		Author:  "Bob <bob@example.com>",
+		Date:    time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		Message: "Initial commit",
+	},
+}
+
+func buildIndexWithHistory(t *testing.T) *Index {
+	ref, err := Build(&IndexOptions{History: testHistory}, t.TempDir(), thisDir(), url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ref.HistoryCommits != len(testHistory) {
+		t.Fatalf("expected %d commits in the manifest, got %d", len(testHistory), ref.HistoryCommits)
+	}
+
+	idx, err := Open(ref.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func hashesOf(commits []*Commit) []string {
+	var hashes []string
+	for _, c := range commits {
+		hashes = append(hashes, c.Hash)
+	}
+	return hashes
+}
+
+func TestSearchDiffs(t *testing.T) {
+	idx := buildIndexWithHistory(t)
+	defer idx.Close()
+
+	res, err := idx.Search("Dial\\(", &SearchOptions{Type: SearchDiffs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashesOf(res.Commits); len(got) != 2 || got[0] != "c3" || got[1] != "c2" || res.FilesWithMatch != 2 {
+		t.Fatalf("expected c3 and c2, got %v", got)
+	}
+	if len(res.Matches) != 0 {
+		t.Fatal("expected no file matches")
+	}
+
+	// Only the hunks with a match are returned.
+	c := res.Commits[0]
+	if len(c.Files) != 2 || len(c.Files[1].Hunks) != 1 || c.Files[1].Hunks[0].Header != "@@ -3 +3 @@" {
+		t.Fatalf("unexpected hunks: %+v", c.Files)
+	}
+	if len(testHistory[0].Files[1].Hunks) != 2 {
+		t.Fatal("expected the history to be left alone")
+	}
+
+	// The + or - isn't matched.
+	res, err = idx.Search("^package", &SearchOptions{Type: SearchDiffs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Commits) != 2 {
+		t.Fatalf("expected 2 commits, got %v", hashesOf(res.Commits))
+	}
+
+	res, err = idx.Search("Dial", &SearchOptions{Type: SearchDiffs, FileRegexp: "main\\.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashesOf(res.Commits); len(got) != 1 || got[0] != "c3" || len(res.Commits[0].Files) != 1 {
+		t.Fatalf("expected only main.go in c3, got %v", got)
+	}
+
+	res, err = idx.Search("Dial", &SearchOptions{Type: SearchDiffs, Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashesOf(res.Commits); len(got) != 1 || got[0] != "c2" || res.FilesWithMatch != 2 {
+		t.Fatalf("expected the second page to be c2, got %v", got)
+	}
+}
+
+func TestSearchCommits(t *testing.T) {
+	idx := buildIndexWithHistory(t)
+	defer idx.Close()
+
+	res, err := idx.Search("legacy", &SearchOptions{Type: SearchCommits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashesOf(res.Commits); len(got) != 2 || got[0] != "c3" || got[1] != "c2" {
+		t.Fatalf("expected c3 and c2, got %v", got)
+	}
+	if res.Commits[0].Files != nil {
+		t.Fatal("expected no diffs for a commit search")
+	}
+
+	res, err = idx.Search("^Nothing", &SearchOptions{Type: SearchCommits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashesOf(res.Commits); len(got) != 1 || got[0] != "c3" {
+		t.Fatalf("expected the body of c3 to match, got %v", got)
+	}
+
+	res, err = idx.Search("bob@", &SearchOptions{Type: SearchCommits, MaxResults: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hashesOf(res.Commits); len(got) != 1 || got[0] != "c2" {
+		t.Fatalf("expected c2, got %v", got)
+	}
+
+	if _, err := idx.Search("legacy", &SearchOptions{Type: "blame"}); err == nil {
+		t.Fatal("expected an unknown search type to fail")
+	}
+}
+
+func TestMissingHistory(t *testing.T) {
+	idx := buildIndexWithHistory(t)
+	defer idx.Close()
+
+	if err := os.Remove(filepath.Join(idx.GetDir(), historyFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Ref.Validate(); err == nil {
+		t.Fatal("expected an index without its history to be invalid")
+	}
+
+	// The history isn't read until it is searched.
+	if _, err := idx.Search("legacy", &SearchOptions{Type: SearchDiffs}); err == nil {
+		t.Fatal("expected searching the missing history to fail")
+	}
+}
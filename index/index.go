@@ -1,13 +1,19 @@
 package index
 
 import (
-	"compress/gzip"
+	"bufio"
+	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -21,22 +27,81 @@ const (
 	filePeekSize             = 2048
 )
 
+// The number of files a search greps in parallel, and how many files each
+// of them is given before the results are merged. Searches that have
+// collected enough results stop at the end of a batch.
+var (
+	grepWorkers   = runtime.NumCPU()
+	filesPerBatch = 16
+)
+
+// Every search greps on its own goroutine, along with as many more as it
+// can take a slot for. The slots are shared by all searches so that the
+// number of goroutines grepping doesn't grow with the number of searches.
+var grepSlots = make(chan struct{}, runtime.NumCPU())
+
+// Take up to n of the free grep slots without waiting, returning how many
+// were taken.
+func acquireGrepSlots(n int) int {
+	for i := 0; i < n; i++ {
+		select {
+		case grepSlots <- struct{}{}:
+		default:
+			return i
+		}
+	}
+	return n
+}
+
+func releaseGrepSlots(n int) {
+	for i := 0; i < n; i++ {
+		<-grepSlots
+	}
+}
+
+// The version of the on-disk index layout and manifest. This must be
+// incremented whenever either changes in a way that older indexes can no
+// longer be searched correctly, which causes them to be rebuilt.
+const ManifestVersion = 4
+
 const (
 	reasonDotFile     = "Dot files are excluded."
 	reasonInvalidMode = "Invalid file mode."
 	reasonNotText     = "Not a text file."
+	reasonReadError   = "Unable to read file."
 )
 
 type Index struct {
-	Ref *IndexRef
-	idx *index.Index
-	lck sync.RWMutex
+	Ref     *IndexRef
+	idx     *index.Index
+	content contentReader
+	lck     sync.RWMutex
+
+	// The history is read the first time it is searched.
+	historyOnce sync.Once
+	history     []*Commit
+	historyErr  error
 }
 
 type IndexOptions struct {
 	ExcludeDotFiles    bool
+	IndexArchives      bool
 	SpecialFiles       []string
 	AutoGeneratedFiles []string
+	Submodules         []*Submodule
+
+	// How the contents of files are kept, one of the Store constants. The
+	// default is StoreFiles.
+	ContentStore string
+
+	// The recent commits of the repo, newest first, that are searched by
+	// the diff and commit search types.
+	History []*Commit
+
+	// How many commits of history are wanted, which is kept in the
+	// manifest to tell when it changes. History can have fewer, like when
+	// the repo is younger or its history couldn't be read.
+	HistoryDepth int
 }
 
 type SearchOptions struct {
@@ -48,6 +113,18 @@ type SearchOptions struct {
 	Offset            int
 	Limit             int
 	MaxResults        int
+
+	// What is searched, one of the Search constants. The default is the
+	// files of the repo.
+	Type string `json:",omitempty"`
+
+	// Only search files in this language, ignoring case.
+	Language string `json:",omitempty"`
+
+	// Leave out files in any of these classes, or list them after the
+	// files that aren't in any.
+	Exclude  FileClass `json:",omitempty"`
+	DownRank FileClass `json:",omitempty"`
 }
 
 type Match struct {
@@ -55,20 +132,67 @@ type Match struct {
 	LineNumber int
 	Before     []string
 	After      []string
+
+	// Who last changed the line, in which commit and when. These are only
+	// set when blame is asked for and the repo's vcs supports it.
+	Author string     `json:",omitempty"`
+	Commit string     `json:",omitempty"`
+	Date   *time.Time `json:",omitempty"`
 }
 
 type SearchResponse struct {
-	Matches        []*FileMatch
+	Matches []*FileMatch
+
+	// The matching commits of a diff or commit search.
+	Commits []*Commit `json:",omitempty"`
+
+	// The number of files that match, or of commits for a diff or commit
+	// search.
 	FilesWithMatch int
 	FilesOpened    int           `json:"-"`
 	Duration       time.Duration `json:"-"`
 	Revision       string
 }
 
+// How a search narrows down the files it reads.
+type Explanation struct {
+	// The trigram query that files must match to be read.
+	Query string
+
+	// The pattern has no trigrams to narrow the search by, so every file
+	// is read.
+	AllFiles bool
+
+	// The number of files that match the query and the search's filters
+	// on file names, languages and classes, and that are in the index.
+	Candidates int
+	Files      int
+}
+
 type FileMatch struct {
 	Filename      string
 	Matches       []*Match
 	AutoGenerated bool
+	Submodule     *Submodule `json:",omitempty"`
+	Language      string     `json:",omitempty"`
+
+	// The names of the classes the file is in, like "vendored" and "test".
+	Classes []string `json:",omitempty"`
+
+	// The hash of the file's content when the index is in the shared
+	// store, used to find the same content in other indexes.
+	ContentHash string `json:"-"`
+
+	// The number of other repos that have a file with the same content.
+	DuplicateRepos int `json:",omitempty"`
+}
+
+// A nested repository whose contents are indexed under Path. Matches in
+// these files link to the submodule's own Url and Rev.
+type Submodule struct {
+	Path string
+	Url  string
+	Rev  string
 }
 
 type ExcludedFile struct {
@@ -77,11 +201,53 @@ type ExcludedFile struct {
 }
 
 type IndexRef struct {
+	Version            int
 	Url                string
 	Rev                string
 	Time               time.Time
 	dir                string
 	AutoGeneratedFiles []string
+	Submodules         []*Submodule
+	ContentStore       string
+	HistoryCommits     int
+	HistoryDepth       int
+
+	// The language of each file by its ID, as one more than its index in
+	// Languages or 0 if it isn't known, and how many files and bytes of
+	// each language there are.
+	Languages     []string
+	FileLanguages []uint8
+	LanguageStats map[string]*LanguageStats
+
+	// The classes of each file by its ID.
+	FileClasses []FileClass
+}
+
+// The language of the file with the given ID, or "" if it isn't known.
+func (r *IndexRef) languageOf(id uint32) string {
+	if int(id) >= len(r.FileLanguages) || r.FileLanguages[id] == 0 {
+		return ""
+	}
+	return r.Languages[r.FileLanguages[id]-1]
+}
+
+// The number that files in lang have in FileLanguages, or false if no file
+// is in lang.
+func (r *IndexRef) languageNumber(lang string) (uint8, bool) {
+	for i, l := range r.Languages {
+		if strings.EqualFold(l, lang) {
+			return uint8(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+// The classes of the file with the given ID.
+func (r *IndexRef) classOf(id uint32) FileClass {
+	if int(id) >= len(r.FileClasses) {
+		return 0
+	}
+	return r.FileClasses[id]
 }
 
 func (r *IndexRef) Dir() string {
@@ -98,27 +264,74 @@ func (r *IndexRef) writeManifest() error {
 	return gob.NewEncoder(w).Encode(r)
 }
 
+// Validate checks that the index directory was built with the current
+// layout and that its files are all present and intact. The returned
+// error describes why the index can't be used.
+func (r *IndexRef) Validate() error {
+	if r.Version != ManifestVersion {
+		return fmt.Errorf("index format version %d, expected %d",
+			r.Version, ManifestVersion)
+	}
+
+	if err := checkContent(r.ContentStore, r.dir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(r.dir, excludedFileJsonFilename)); err != nil {
+		return err
+	}
+
+	if r.HistoryCommits > 0 {
+		if _, err := os.Stat(filepath.Join(r.dir, historyFilename)); err != nil {
+			return err
+		}
+	}
+
+	return index.Check(filepath.Join(r.dir, "tri"))
+}
+
 func (r *IndexRef) Open() (*Index, error) {
+	content, err := openContent(r.ContentStore, r.dir)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Index{
-		Ref: r,
-		idx: index.Open(filepath.Join(r.dir, "tri")),
+		Ref:     r,
+		idx:     index.Open(filepath.Join(r.dir, "tri")),
+		content: content,
 	}, nil
 }
 
+// Remove the index directory, along with any shared content that only it
+// used.
 func (r *IndexRef) Remove() error {
+	// The manifest can't be relied on here, since this is also used to
+	// clean up indexes that are broken.
+	if _, err := os.Stat(filepath.Join(r.dir, blobListFilename)); err == nil {
+		return removeShared(r.dir)
+	}
 	return os.RemoveAll(r.dir)
 }
 
+func (n *Index) close() error {
+	err := n.idx.Close()
+	if e := n.content.close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
 func (n *Index) Close() error {
 	n.lck.Lock()
 	defer n.lck.Unlock()
-	return n.idx.Close()
+	return n.close()
 }
 
 func (n *Index) Destroy() error {
 	n.lck.Lock()
 	defer n.lck.Unlock()
-	if err := n.idx.Close(); err != nil {
+	if err := n.close(); err != nil {
 		return err
 	}
 	return n.Ref.Remove()
@@ -143,52 +356,88 @@ func GetRegexpPattern(pat string, ignoreCase bool) string {
 	return "(?m)" + pat
 }
 
-func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error) {
-	startedAt := time.Now()
+// Compile the search pattern the way it is matched against file contents.
+func compilePattern(pat string, opt *SearchOptions) (*regexp.Regexp, error) {
+	if opt.LiteralSearch {
+		pat = regexp.QuoteMeta(pat)
+	}
+	return regexp.Compile(GetRegexpPattern(pat, opt.IgnoreCase))
+}
+
+// The trigram query used to find the files that may match a search.
+func trigramQuery(pat string, opt *SearchOptions) (*index.Query, error) {
+	re, err := compilePattern(pat, opt)
+	if err != nil {
+		return nil, err
+	}
+	return index.RegexpQuery(re.Syntax), nil
+}
 
+// The trigram query used to find the files that may match a search, as a
+// string.
+func QueryPlan(pat string, opt *SearchOptions) (string, error) {
+	q, err := trigramQuery(pat, opt)
+	if err != nil {
+		return "", err
+	}
+	return q.String(), nil
+}
+
+// The pattern of a search as it is matched, so that searches that only
+// differ in how the pattern was written can be treated as the same search.
+// The pattern includes the effect of IgnoreCase and LiteralSearch.
+func NormalizePattern(pat string, opt *SearchOptions) (string, error) {
+	re, err := compilePattern(pat, opt)
+	if err != nil {
+		return "", err
+	}
+	return re.Syntax.Simplify().String(), nil
+}
+
+// Explain how a search narrows down the files it reads, without reading
+// them.
+func (n *Index) Explain(pat string, opt *SearchOptions) (*Explanation, error) {
 	n.lck.RLock()
 	defer n.lck.RUnlock()
 
-	patForRe := pat
-	if opt.LiteralSearch {
-		patForRe = regexp.QuoteMeta(pat)
+	q, err := trigramQuery(pat, opt)
+	if err != nil {
+		return nil, err
 	}
 
-	re, err := regexp.Compile(GetRegexpPattern(patForRe, opt.IgnoreCase))
+	_, names, err := n.candidates(q, opt)
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		g                grepper
-		results          []*FileMatch
-		filesOpened      int
-		filesFound       int
-		filesCollected   int
-		matchesCollected int
-	)
+	return &Explanation{
+		Query:      q.String(),
+		AllFiles:   q.Op == index.QAll,
+		Candidates: len(names),
+		Files:      n.idx.NumNames(),
+	}, nil
+}
 
-	var fre *regexp.Regexp
-	if opt.FileRegexp != "" {
-		fre, err = regexp.Compile(opt.FileRegexp)
-		if err != nil {
-			return nil, err
-		}
+// The IDs and names of the files that match the trigram query and the
+// filters in opt, in the order they are searched. The caller must hold lck.
+func (n *Index) candidates(q *index.Query, opt *SearchOptions) ([]uint32, []string, error) {
+	fre, excludeFre, err := compileFileRegexps(opt)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var excludeFre *regexp.Regexp
-	if opt.ExcludeFileRegexp != "" {
-		excludeFre, err = regexp.Compile(opt.ExcludeFileRegexp)
-		if err != nil {
-			return nil, err
+	var lang uint8
+	if opt.Language != "" {
+		var ok bool
+		if lang, ok = n.Ref.languageNumber(opt.Language); !ok {
+			return nil, nil, nil
 		}
 	}
 
-	files := n.idx.PostingQuery(index.RegexpQuery(re.Syntax))
-	for _, file := range files {
-		var matches []*Match
+	var ids []uint32
+	var names []string
+	for _, file := range n.idx.PostingQuery(q) {
 		name := n.idx.Name(file)
-		hasMatch := false
 
 		// reject files that do not match the file pattern
 		if fre != nil && fre.MatchString(name, true, true) < 0 {
@@ -200,49 +449,257 @@ func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error)
 			continue
 		}
 
-		// if we already have more results than the limit on this index, skip this file
-		if opt.MaxResults > 0 && matchesCollected >= opt.MaxResults {
+		// reject files in other languages
+		if lang != 0 && (int(file) >= len(n.Ref.FileLanguages) || n.Ref.FileLanguages[file] != lang) {
 			continue
 		}
 
-		filesOpened++
-		if err := g.grep2File(filepath.Join(n.Ref.dir, "raw", name), re, int(opt.LinesOfContext),
-			func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error) {
+		// reject files in excluded classes
+		if n.Ref.classOf(file)&opt.Exclude != 0 {
+			continue
+		}
+
+		ids = append(ids, file)
+		names = append(names, name)
+	}
 
-				hasMatch = true
-				if filesFound < opt.Offset || (opt.Limit > 0 && filesCollected >= opt.Limit) {
-					return false, nil
-				}
+	// Down ranked files are searched last, so that they come after the
+	// rest when the results are paged.
+	if opt.DownRank != 0 {
+		sort.Stable(&byDownRank{ids, names, n.Ref, opt.DownRank})
+	}
+
+	return ids, names, nil
+}
 
-				matchesCollected++
-				matches = append(matches, &Match{
-					Line:       string(line),
-					LineNumber: lineno,
-					Before:     toStrings(before),
-					After:      toStrings(after),
-				})
+// Sorts files in the down ranked classes after the rest.
+type byDownRank struct {
+	ids   []uint32
+	names []string
+	ref   *IndexRef
+	rank  FileClass
+}
+
+func (s *byDownRank) Len() int {
+	return len(s.ids)
+}
+
+func (s *byDownRank) Less(i, j int) bool {
+	return s.ref.classOf(s.ids[i])&s.rank == 0 &&
+		s.ref.classOf(s.ids[j])&s.rank != 0
+}
+
+func (s *byDownRank) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+// The result of grepping a single file.
+type grepResult struct {
+	matches  []*Match
+	hasMatch bool
+	hash     string
+	err      error
+}
+
+// Grep a single file, collecting at most max matches (or all of them if max
+// is 0). If firstOnly is set, only whether the file has a match is found.
+func (n *Index) grepOne(g *grepper, name string, re *regexp.Regexp, nctx, max int, firstOnly bool) grepResult {
+	var r grepResult
+	buf, err := n.content.read(g, name)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	r.err = grep2Buf(buf, re, nctx,
+		func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error) {
+			r.hasMatch = true
+			if firstOnly {
+				return false, nil
+			}
+
+			r.matches = append(r.matches, &Match{
+				Line:       string(line),
+				LineNumber: lineno,
+				Before:     toStrings(before),
+				After:      toStrings(after),
+			})
 
-				if opt.MaxResults > 0 && matchesCollected >= opt.MaxResults {
-					return false, nil
-				}
+			return max <= 0 || len(r.matches) < max, nil
+		})
 
-				return true, nil
-			}); err != nil {
+	if len(r.matches) > 0 {
+		r.hash = n.contentHash(buf)
+	}
+	return r
+}
+
+// Each worker needs its own regexp as well as its own buffer, matching
+// isn't safe to do concurrently with the same regexp.
+type grepWorker struct {
+	g  grepper
+	re *regexp.Regexp
+}
+
+// Grep the files in names in parallel, one goroutine per worker, storing
+// the result of names[i] in res[i].
+func (n *Index) grepBatch(
+	workers []grepWorker,
+	names []string,
+	nctx, max int,
+	firstOnlyBefore int,
+	res []grepResult) {
+	var wg sync.WaitGroup
+	next := int32(-1)
+	work := func(w *grepWorker) {
+		for {
+			j := int(atomic.AddInt32(&next, 1))
+			if j >= len(names) {
+				return
+			}
+			res[j] = n.grepOne(&w.g, names[j], w.re, nctx, max, j < firstOnlyBefore)
+		}
+	}
+
+	// The first worker runs on the caller's goroutine.
+	for i := 1; i < len(workers); i++ {
+		wg.Add(1)
+		go func(w *grepWorker) {
+			defer wg.Done()
+			work(w)
+		}(&workers[i])
+	}
+	work(&workers[0])
+	wg.Wait()
+}
+
+// Compile the patterns that the names of files must match, and must not
+// match, to be searched. Either is nil if it isn't given.
+func compileFileRegexps(opt *SearchOptions) (fre, excludeFre *regexp.Regexp, err error) {
+	if opt.FileRegexp != "" {
+		if fre, err = regexp.Compile(opt.FileRegexp); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opt.ExcludeFileRegexp != "" {
+		if excludeFre, err = regexp.Compile(opt.ExcludeFileRegexp); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return fre, excludeFre, nil
+}
+
+func (n *Index) Search(pat string, opt *SearchOptions) (*SearchResponse, error) {
+	if opt.Type != SearchFiles {
+		return n.searchHistory(pat, opt)
+	}
+
+	startedAt := time.Now()
+
+	n.lck.RLock()
+	defer n.lck.RUnlock()
+
+	re, err := compilePattern(pat, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results          []*FileMatch
+		filesOpened      int
+		filesFound       int
+		filesCollected   int
+		matchesCollected int
+	)
+
+	ids, names, err := n.candidates(index.RegexpQuery(re.Syntax), opt)
+	if err != nil {
+		return nil, err
+	}
+
+	nworkers := grepWorkers
+	if nworkers > len(names) {
+		nworkers = len(names)
+	}
+	if nworkers > 1 {
+		extra := acquireGrepSlots(nworkers - 1)
+		defer releaseGrepSlots(extra)
+		nworkers = 1 + extra
+	}
+	workers := make([]grepWorker, nworkers)
+	for i := range workers {
+		if i == 0 {
+			workers[i].re = re
+		} else if workers[i].re, err = compilePattern(pat, opt); err != nil {
 			return nil, err
 		}
+	}
+	batch := make([]grepResult, nworkers*filesPerBatch)
 
-		if !hasMatch {
-			continue
+	// The files are grepped in parallel a batch at a time, then the results
+	// are merged in file order so that they are the same as if the files
+	// had been grepped one after another.
+	for start := 0; start < len(names); start += len(batch) {
+		// if we already have more results than the limit on this index, stop
+		if opt.MaxResults > 0 && matchesCollected >= opt.MaxResults {
+			break
 		}
 
-		filesFound++
-		if len(matches) > 0 {
+		end := start + len(batch)
+		if end > len(names) {
+			end = len(names)
+		}
+		res := batch[:end-start]
+
+		// Files that are skipped over by the offset, and every file once the
+		// page is full, are only grepped to count them. Files in the batch
+		// are certain to be skipped while fewer than the offset would be
+		// found even if every file before them matched.
+		firstOnlyBefore := opt.Offset - filesFound
+		if opt.Limit > 0 && filesCollected >= opt.Limit {
+			firstOnlyBefore = len(res)
+		}
+		n.grepBatch(workers, names[start:end], int(opt.LinesOfContext), opt.MaxResults, firstOnlyBefore, res)
+
+		for i, r := range res {
+			if opt.MaxResults > 0 && matchesCollected >= opt.MaxResults {
+				break
+			}
+			filesOpened++
+
+			if r.err != nil {
+				return nil, r.err
+			}
+
+			if !r.hasMatch {
+				continue
+			}
+
+			if filesFound < opt.Offset || (opt.Limit > 0 && filesCollected >= opt.Limit) {
+				filesFound++
+				continue
+			}
+
+			matches := r.matches
+			if opt.MaxResults > 0 && len(matches) > opt.MaxResults-matchesCollected {
+				matches = matches[:opt.MaxResults-matchesCollected]
+			}
+			matchesCollected += len(matches)
+			filesFound++
 			filesCollected++
 
+			id, name := ids[start+i], names[start+i]
 			results = append(results, &FileMatch{
 				Filename:      name,
 				Matches:       matches,
-				AutoGenerated: containsString(n.Ref.AutoGeneratedFiles, name),
+				AutoGenerated: containsString(n.Ref.AutoGeneratedFiles, name) || n.Ref.classOf(id)&ClassGenerated != 0,
+				Submodule:     submoduleFor(n.Ref.Submodules, name),
+				Language:      n.Ref.languageOf(id),
+				Classes:       n.Ref.classOf(id).Names(),
+				ContentHash:   r.hash,
 			})
 		}
 	}
@@ -269,16 +726,19 @@ func isTextFile(filename string) (bool, error) {
 		return false, err
 	}
 
-	buf = buf[:n]
+	return isText(buf[:n], n < filePeekSize), nil
+}
 
-	if n < filePeekSize {
+// Determines if the buffer holds text. If whole is false, the buffer is
+// only a prefix of the content.
+func isText(buf []byte, whole bool) bool {
+	if whole {
 		// read the whole file, must be valid.
-		return utf8.Valid(buf), nil
+		return utf8.Valid(buf)
 	}
 
 	// read a prefix, allow trailing partial runes.
-	return validUTF8IgnoringPartialTrailingRune(buf), nil
-
+	return validUTF8IgnoringPartialTrailingRune(buf)
 }
 
 // Determines if the buffer contains valid UTF8 encoded string data. The buffer is assumed
@@ -307,7 +767,7 @@ func validUTF8IgnoringPartialTrailingRune(p []byte) bool {
 	return true
 }
 
-func addFileToIndex(ix *index.IndexWriter, dst, src, path string) (string, error) {
+func addFileToIndex(ix *index.IndexWriter, cw contentWriter, meta *fileMetadata, src, path string) (string, error) {
 	rel, err := filepath.Rel(src, path)
 	if err != nil {
 		return "", err
@@ -319,31 +779,109 @@ func addFileToIndex(ix *index.IndexWriter, dst, src, path string) (string, error
 	}
 	defer r.Close()
 
-	dup := filepath.Join(dst, "raw", rel)
-	w, err := os.Create(dup)
+	return addToIndex(ix, cw, meta, rel, r)
+}
+
+// Add the contents of r to the index under name, keeping a copy in the
+// content store for grepping.
+func addToIndex(ix *index.IndexWriter, cw contentWriter, meta *fileMetadata, name string, r io.Reader) (string, error) {
+	br := bufio.NewReaderSize(r, filePeekSize)
+	head, err := br.Peek(filePeekSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	// The peeked bytes are only good until the next read.
+	head = append([]byte(nil), head...)
+
+	w, err := cw.create(name)
 	if err != nil {
 		return "", err
 	}
-	defer w.Close()
 
-	g := gzip.NewWriter(w)
-	defer g.Close()
+	cr := &countingReader{r: br}
+	id := ix.NumNames()
+	reason := ix.Add(name, io.TeeReader(cr, w))
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	// The index leaves out files that it couldn't read to the end.
+	if ix.NumNames() == id {
+		if reason == "" {
+			reason = reasonReadError
+		}
+		return reason, nil
+	}
 
-	return ix.Add(rel, io.TeeReader(r, g)), nil
+	meta.add(uint32(id), name, head, cr.n, cr.lines)
+	return "", nil
 }
 
-func addDirToIndex(dst, src, path string) error {
-	rel, err := filepath.Rel(src, path)
-	if err != nil {
-		return err
+// Counts the bytes and lines that are read through it, and keeps the first
+// error other than io.EOF.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	lines int64
+	err   error
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	c.lines += int64(bytes.Count(b[:n], []byte("\n")))
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
 	}
+	return n, err
+}
 
-	if rel == "." {
-		return nil
+// What is learned about the files that are added to an index: the language
+// of each file and the totals for each language, and the classes of each
+// file. Files are kept by their ID in the index.
+type fileMetadata struct {
+	languages     []string
+	numbers       map[string]uint8
+	fileLanguages []uint8
+	languageStats map[string]*LanguageStats
+	classes       []FileClass
+}
+
+func newFileMetadata() *fileMetadata {
+	return &fileMetadata{
+		numbers:       map[string]uint8{},
+		languageStats: map[string]*LanguageStats{},
+	}
+}
+
+func (m *fileMetadata) add(id uint32, name string, head []byte, size, lines int64) {
+	for len(m.classes) <= int(id) {
+		m.classes = append(m.classes, 0)
+		m.fileLanguages = append(m.fileLanguages, 0)
+	}
+
+	m.classes[id] = classify(name, head, size, lines)
+
+	lang := languageFor(name, head)
+	if lang == "" {
+		return
+	}
+
+	num, ok := m.numbers[lang]
+	if !ok {
+		m.languages = append(m.languages, lang)
+		num = uint8(len(m.languages))
+		m.numbers[lang] = num
 	}
+	m.fileLanguages[id] = num
 
-	dup := filepath.Join(dst, "raw", rel)
-	return os.Mkdir(dup, os.ModePerm)
+	s := m.languageStats[lang]
+	if s == nil {
+		s = &LanguageStats{}
+		m.languageStats[lang] = s
+	}
+	s.Files++
+	s.Bytes += size
 }
 
 // write the list of excluded files to the given filename.
@@ -366,10 +904,33 @@ func containsString(haystack []string, needle string) bool {
 	return false
 }
 
-func indexAllFiles(opt *IndexOptions, dst, src string) error {
+// Find the innermost submodule that contains the given file, returns nil
+// if the file belongs to the repository itself.
+func submoduleFor(subs []*Submodule, name string) *Submodule {
+	name = filepath.ToSlash(name)
+
+	var found *Submodule
+	for _, sub := range subs {
+		if !strings.HasPrefix(name, sub.Path+"/") {
+			continue
+		}
+
+		if found == nil || len(sub.Path) > len(found.Path) {
+			found = sub
+		}
+	}
+	return found
+}
+
+func indexAllFiles(opt *IndexOptions, meta *fileMetadata, dst, src string) error {
 	ix := index.Create(filepath.Join(dst, "tri"))
 	defer ix.Close()
 
+	cw, err := newContentWriter(opt.ContentStore, dst)
+	if err != nil {
+		return err
+	}
+
 	excluded := []*ExcludedFile{}
 
 	// Make a file to store the excluded files for this repo
@@ -415,7 +976,7 @@ func indexAllFiles(opt *IndexOptions, dst, src string) error {
 		}
 
 		if info.IsDir() {
-			return addDirToIndex(dst, src, path)
+			return nil
 		}
 
 		if info.Mode()&os.ModeType != 0 {
@@ -426,6 +987,15 @@ func indexAllFiles(opt *IndexOptions, dst, src string) error {
 			return nil
 		}
 
+		if opt.IndexArchives && isArchive(name) {
+			ex, err := addArchiveToIndex(ix, cw, meta, src, path)
+			if err != nil {
+				return err
+			}
+			excluded = append(excluded, ex...)
+			return nil
+		}
+
 		txt, err := isTextFile(path)
 		if err != nil {
 			return err
@@ -439,7 +1009,7 @@ func indexAllFiles(opt *IndexOptions, dst, src string) error {
 			return nil
 		}
 
-		reasonForExclusion, err := addFileToIndex(ix, dst, src, path)
+		reasonForExclusion, err := addFileToIndex(ix, cw, meta, src, path)
 		if err != nil {
 			return err
 		}
@@ -449,6 +1019,11 @@ func indexAllFiles(opt *IndexOptions, dst, src string) error {
 
 		return nil
 	}); err != nil {
+		cw.close()
+		return err
+	}
+
+	if err := cw.close(); err != nil {
 		return err
 	}
 
@@ -486,26 +1061,42 @@ func Read(dir string) (*IndexRef, error) {
 }
 
 func Build(opt *IndexOptions, dst, src, url, rev string) (*IndexRef, error) {
+	if err := validContentStore(opt.ContentStore); err != nil {
+		return nil, err
+	}
+
 	if _, err := os.Stat(dst); err != nil {
 		if err := os.MkdirAll(dst, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := os.Mkdir(filepath.Join(dst, "raw"), os.ModePerm); err != nil {
+	meta := newFileMetadata()
+	if err := indexAllFiles(opt, meta, dst, src); err != nil {
 		return nil, err
 	}
 
-	if err := indexAllFiles(opt, dst, src); err != nil {
-		return nil, err
+	if len(opt.History) > 0 {
+		if err := writeHistory(dst, opt.History); err != nil {
+			return nil, err
+		}
 	}
 
 	r := &IndexRef{
+		Version:            ManifestVersion,
 		Url:                url,
 		Rev:                rev,
 		Time:               time.Now(),
 		dir:                dst,
 		AutoGeneratedFiles: opt.AutoGeneratedFiles,
+		Submodules:         opt.Submodules,
+		ContentStore:       opt.ContentStore,
+		HistoryCommits:     len(opt.History),
+		HistoryDepth:       opt.HistoryDepth,
+		Languages:          meta.languages,
+		FileLanguages:      meta.fileLanguages,
+		LanguageStats:      meta.languageStats,
+		FileClasses:        meta.classes,
 	}
 
 	if err := r.writeManifest(); err != nil {
@@ -522,5 +1113,9 @@ func Open(dir string) (*Index, error) {
 		return nil, err
 	}
 
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
 	return r.Open()
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 )
@@ -96,6 +97,145 @@ func TestSearchWithLimits(t *testing.T) {
 	}
 }
 
+// Grepping in parallel gives the same results as grepping one file at a
+// time, and counts the same files as opened.
+func TestParallelSearch(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	defer func(workers, perBatch int) {
+		grepWorkers, filesPerBatch = workers, perBatch
+	}(grepWorkers, filesPerBatch)
+
+	search := func(workers, perBatch int, opt *SearchOptions) *SearchResponse {
+		grepWorkers, filesPerBatch = workers, perBatch
+		res, err := idx.Search("func|8365a", opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Duration = 0
+		return res
+	}
+
+	tests := []*SearchOptions{
+		{},
+		{MaxResults: 100},
+		{MaxResults: 7},
+		{Offset: 2, Limit: 3},
+		{Offset: 1, Limit: 2, MaxResults: 5},
+		{Limit: 1, LinesOfContext: 2},
+	}
+
+	for _, opt := range tests {
+		expected := search(1, 1, opt)
+		if len(expected.Matches) == 0 {
+			t.Fatalf("%+v: expected matches", opt)
+		}
+
+		for _, workers := range []int{2, 4, 8} {
+			got := search(workers, 2, opt)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%+v: with %d workers, expected %d files (%d found), got %d (%d found)",
+					opt, workers, len(expected.Matches), expected.FilesWithMatch,
+					len(got.Matches), got.FilesWithMatch)
+			}
+		}
+	}
+}
+
+// Searches still run when every grep slot is taken, on their own goroutine,
+// and give back the slots they take.
+func TestGrepSlots(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	expected, err := idx.Search("func", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grepSlots) != 0 {
+		t.Fatalf("expected the slots to be given back, %d are taken", len(grepSlots))
+	}
+
+	taken := acquireGrepSlots(cap(grepSlots))
+	defer releaseGrepSlots(taken)
+
+	got, err := idx.Search("func", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Matches) != len(expected.Matches) {
+		t.Fatalf("expected %d files, got %d", len(expected.Matches), len(got.Matches))
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	e, err := idx.Explain("func TestExplain", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.AllFiles || e.Candidates < 1 || e.Candidates >= e.Files {
+		t.Fatalf("expected the query to narrow down the files, got %+v", e)
+	}
+
+	e, err = idx.Explain("a.b", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.AllFiles || e.Query != "+" || e.Candidates != e.Files {
+		t.Fatalf("expected every file to be a candidate, got %+v", e)
+	}
+
+	// The same filters as a search apply to the candidates.
+	for _, test := range []struct {
+		opt        *SearchOptions
+		candidates int
+	}{
+		{&SearchOptions{FileRegexp: "index_test\\.go$"}, 1},
+		{&SearchOptions{ExcludeFileRegexp: "_test\\.go$"}, 0},
+		{&SearchOptions{Language: "Markdown"}, 0},
+		{&SearchOptions{Exclude: ClassTest}, 0},
+	} {
+		e, err := idx.Explain("func TestExplain", test.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Candidates != test.candidates {
+			t.Errorf("%+v: expected %d candidates, got %d", test.opt, test.candidates, e.Candidates)
+		}
+	}
+}
+
 func TestRemove(t *testing.T) {
 	ref, err := buildIndex(url, rev)
 	if err != nil {
@@ -137,3 +277,117 @@ func TestRead(t *testing.T) {
 	}
 	defer idx.Close()
 }
+
+func TestValidate(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	r, err := Read(ref.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Version != ManifestVersion {
+		t.Fatalf("expected version %d, got %d", ManifestVersion, r.Version)
+	}
+
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An index from an older layout must not be reused.
+	r.Version = ManifestVersion - 1
+	if err := r.Validate(); err == nil {
+		t.Fatal("expected an error for an incompatible version")
+	}
+	r.Version = ManifestVersion
+
+	// Nor can an index whose trigram file is corrupt.
+	if err := os.Truncate(filepath.Join(ref.Dir(), "tri"), 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Validate(); err == nil {
+		t.Fatal("expected an error for a truncated index")
+	}
+
+	if _, err := Open(ref.Dir()); err == nil {
+		t.Fatal("expected an error opening a truncated index")
+	}
+}
+
+func TestSearchInSubmodules(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "hound-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	files := map[string]string{
+		"main.go":              "package main // HoundSubmoduleNeedle\n",
+		"lib/lib.go":           "package lib // HoundSubmoduleNeedle\n",
+		"lib/nested/nested.go": "package nested // HoundSubmoduleNeedle\n",
+		"library/library.go":   "package library // HoundSubmoduleNeedle\n",
+	}
+	for name, body := range files {
+		filename := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib := &Submodule{Path: "lib", Url: "https://example.com/lib.git", Rev: "r1"}
+	nested := &Submodule{Path: "lib/nested", Url: "https://example.com/nested.git", Rev: "r2"}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := Build(&IndexOptions{Submodules: []*Submodule{nested, lib}}, dir, src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res, err := idx.Search("HoundSubmoduleNeedle", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files take the innermost submodule holding them, and a directory that
+	// only shares a prefix with a submodule isn't in it.
+	expected := map[string]string{
+		"main.go":              "",
+		"lib/lib.go":           "lib",
+		"lib/nested/nested.go": "lib/nested",
+		"library/library.go":   "",
+	}
+	if len(res.Matches) != len(expected) {
+		t.Fatalf("expected %d files, got %d", len(expected), len(res.Matches))
+	}
+	for _, m := range res.Matches {
+		want, ok := expected[m.Filename]
+		if !ok {
+			t.Fatalf("unexpected match in %s", m.Filename)
+		}
+
+		got := ""
+		if m.Submodule != nil {
+			got = m.Submodule.Path
+		}
+		if got != want {
+			t.Fatalf("expected %s to be in submodule %q, got %q", m.Filename, want, got)
+		}
+	}
+}
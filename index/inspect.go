@@ -0,0 +1,237 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hound-search/hound/codesearch/index"
+)
+
+type PostingListStats struct {
+	Trigram string
+	Files   int
+}
+
+// A summary of the contents of an index directory.
+type IndexStats struct {
+	Ref      *IndexRef
+	Files    int
+	Trigrams int
+	Postings int
+	Largest  []*PostingListStats
+	Excluded []*ExcludedFile
+}
+
+// A file whose trigrams in the index disagree with its stored content.
+type VerifyError struct {
+	Filename string
+	Missing  int
+	Extra    int
+	Err      error
+}
+
+func (e *VerifyError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Filename, e.Err)
+	}
+	return fmt.Sprintf("%s: %d trigrams missing from the index, %d unexpected",
+		e.Filename, e.Missing, e.Extra)
+}
+
+func trigramString(t uint32) string {
+	return string([]byte{byte(t >> 16), byte(t >> 8), byte(t)})
+}
+
+func readExcludedFiles(dir string) ([]*ExcludedFile, error) {
+	r, err := os.Open(filepath.Join(dir, excludedFileJsonFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var files []*ExcludedFile
+	if err := json.NewDecoder(r).Decode(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Inspect reads the manifest and trigram index in dir and summarizes them,
+// including the top largest posting lists.
+func Inspect(dir string, top int) (*IndexStats, error) {
+	ref, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded, err := readExcludedFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := index.Check(filepath.Join(dir, "tri")); err != nil {
+		return nil, err
+	}
+
+	ix := index.Open(filepath.Join(dir, "tri"))
+	defer ix.Close()
+
+	st := &IndexStats{
+		Ref:      ref,
+		Files:    ix.NumNames(),
+		Trigrams: ix.NumTrigrams(),
+		Excluded: excluded,
+	}
+
+	var lists []*PostingListStats
+	ix.Trigrams(func(t uint32, count int) {
+		st.Postings += count
+		lists = append(lists, &PostingListStats{trigramString(t), count})
+	})
+
+	sort.SliceStable(lists, func(i, j int) bool {
+		return lists[i].Files > lists[j].Files
+	})
+	if len(lists) > top {
+		lists = lists[:top]
+	}
+	st.Largest = lists
+
+	return st, nil
+}
+
+// Compute the set of trigrams in the content of r the same way that the
+// index writer does, returned as a sorted list.
+func trigramsOf(r io.Reader) ([]uint32, error) {
+	var (
+		buf  = make([]byte, 16384)
+		seen = map[uint32]bool{}
+		tv   uint32
+		n    int64
+	)
+
+	for {
+		m, err := r.Read(buf)
+		for _, c := range buf[:m] {
+			tv = (tv<<8)&(1<<24-1) | uint32(c)
+			if n++; n >= 3 {
+				seen[tv] = true
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	tris := make([]uint32, 0, len(seen))
+	for t := range seen {
+		tris = append(tris, t)
+	}
+	sort.Slice(tris, func(i, j int) bool { return tris[i] < tris[j] })
+	return tris, nil
+}
+
+func trigramsOfFile(content contentReader, g *grepper, name string) ([]uint32, error) {
+	buf, err := content.read(g, name)
+	if err != nil {
+		return nil, err
+	}
+	return trigramsOf(bytes.NewReader(buf))
+}
+
+// Count the trigrams that are only in a and only in b. Both lists must be
+// sorted.
+func diffTrigrams(a, b []uint32) (int, int) {
+	var onlyA, onlyB int
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			onlyA++
+			i++
+		case i == len(a) || a[i] > b[j]:
+			onlyB++
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return onlyA, onlyB
+}
+
+// Verify recomputes the trigrams of every file from its stored content and
+// compares them with the posting lists in the index. Each file that does
+// not agree is returned, an error is only returned if the index could not
+// be read at all.
+func Verify(dir string) ([]*VerifyError, error) {
+	ref, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ref.Validate(); err != nil {
+		return nil, err
+	}
+
+	ix := index.Open(filepath.Join(dir, "tri"))
+	defer ix.Close()
+
+	content, err := openContent(ref.ContentStore, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer content.close()
+
+	var g grepper
+	var errs []*VerifyError
+	numNames := ix.NumNames()
+
+	// collect the trigrams of every file from the posting lists, which are
+	// each decoded once and come out in sorted order. This holds all of the
+	// postings in memory, at four bytes each.
+	indexed := make([][]uint32, numNames)
+	ix.Trigrams(func(t uint32, count int) {
+		for _, id := range ix.PostingList(t) {
+			if int(id) >= numNames {
+				errs = append(errs, &VerifyError{
+					Filename: fmt.Sprintf("%q", trigramString(t)),
+					Err:      fmt.Errorf("posting list refers to unknown file %d", id),
+				})
+				continue
+			}
+			indexed[id] = append(indexed[id], t)
+		}
+	})
+
+	for id, tris := range indexed {
+		name := ix.Name(uint32(id))
+		actual, err := trigramsOfFile(content, &g, name)
+
+		// the trigrams of the file are no longer needed once compared.
+		indexed[id] = nil
+
+		if err != nil {
+			errs = append(errs, &VerifyError{Filename: name, Err: err})
+			continue
+		}
+
+		if missing, extra := diffTrigrams(actual, tris); missing > 0 || extra > 0 {
+			errs = append(errs, &VerifyError{
+				Filename: name,
+				Missing:  missing,
+				Extra:    extra,
+			})
+		}
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,75 @@
+package index
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	st, err := Inspect(ref.Dir(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Ref.Url != url || st.Ref.Rev != rev {
+		t.Fatalf("unexpected manifest: %+v", st.Ref)
+	}
+
+	if st.Files == 0 || st.Trigrams == 0 {
+		t.Fatalf("expected files and trigrams, got %d and %d", st.Files, st.Trigrams)
+	}
+
+	if len(st.Largest) != 5 {
+		t.Fatalf("expected 5 posting lists, got %d", len(st.Largest))
+	}
+
+	for i := 1; i < len(st.Largest); i++ {
+		if st.Largest[i].Files > st.Largest[i-1].Files {
+			t.Fatal("posting lists are not sorted by size")
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ref, err := buildIndex(url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Remove() //nolint
+
+	errs, err := Verify(ref.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("expected a clean index, got %v", errs)
+	}
+
+	// Replace the content of one of the raw files and make sure it is caught.
+	w, err := os.Create(filepath.Join(ref.Dir(), "raw", "index.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := gzip.NewWriter(w)
+	if _, err := g.Write([]byte("something else entirely\n")); err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+	w.Close()
+
+	errs, err = Verify(ref.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].Filename != "index.go" {
+		t.Fatalf("expected index.go to fail verification, got %v", errs)
+	}
+}
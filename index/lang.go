@@ -0,0 +1,193 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Languages of files by their whole name, checked before their extension.
+var languagesByFilename = map[string]string{
+	"BUILD":            "Starlark",
+	"BUILD.bazel":      "Starlark",
+	"CMakeLists.txt":   "CMake",
+	"Dockerfile":       "Dockerfile",
+	"GNUmakefile":      "Makefile",
+	"Gemfile":          "Ruby",
+	"Jenkinsfile":      "Groovy",
+	"Makefile":         "Makefile",
+	"Podfile":          "Ruby",
+	"Rakefile":         "Ruby",
+	"Vagrantfile":      "Ruby",
+	"WORKSPACE":        "Starlark",
+	"go.mod":           "Go Module",
+	"go.sum":           "Go Checksums",
+	"makefile":         "Makefile",
+	"package.json":     "JSON",
+	"requirements.txt": "Pip Requirements",
+}
+
+// Languages of files by their lower cased extension.
+var languagesByExtension = map[string]string{
+	".bash":       "Shell",
+	".bat":        "Batchfile",
+	".bzl":        "Starlark",
+	".c":          "C",
+	".cc":         "C++",
+	".clj":        "Clojure",
+	".cmake":      "CMake",
+	".cpp":        "C++",
+	".cs":         "C#",
+	".css":        "CSS",
+	".cxx":        "C++",
+	".dart":       "Dart",
+	".dockerfile": "Dockerfile",
+	".el":         "Emacs Lisp",
+	".erl":        "Erlang",
+	".ex":         "Elixir",
+	".exs":        "Elixir",
+	".fs":         "F#",
+	".go":         "Go",
+	".gradle":     "Gradle",
+	".groovy":     "Groovy",
+	".h":          "C",
+	".hcl":        "HCL",
+	".hh":         "C++",
+	".hpp":        "C++",
+	".hs":         "Haskell",
+	".htm":        "HTML",
+	".html":       "HTML",
+	".ini":        "INI",
+	".java":       "Java",
+	".js":         "JavaScript",
+	".json":       "JSON",
+	".jsx":        "JavaScript",
+	".kt":         "Kotlin",
+	".kts":        "Kotlin",
+	".less":       "Less",
+	".lua":        "Lua",
+	".m":          "Objective-C",
+	".md":         "Markdown",
+	".mjs":        "JavaScript",
+	".mk":         "Makefile",
+	".ml":         "OCaml",
+	".mm":         "Objective-C++",
+	".php":        "PHP",
+	".pl":         "Perl",
+	".pm":         "Perl",
+	".proto":      "Protocol Buffer",
+	".ps1":        "PowerShell",
+	".py":         "Python",
+	".r":          "R",
+	".rb":         "Ruby",
+	".rs":         "Rust",
+	".rst":        "reStructuredText",
+	".scala":      "Scala",
+	".scss":       "SCSS",
+	".sh":         "Shell",
+	".sql":        "SQL",
+	".swift":      "Swift",
+	".tf":         "Terraform",
+	".tfvars":     "Terraform",
+	".toml":       "TOML",
+	".ts":         "TypeScript",
+	".tsx":        "TSX",
+	".txt":        "Text",
+	".vue":        "Vue",
+	".xml":        "XML",
+	".yaml":       "YAML",
+	".yml":        "YAML",
+	".zsh":        "Shell",
+}
+
+// Languages of scripts by the interpreter named in their shebang line.
+var languagesByInterpreter = map[string]string{
+	"bash":    "Shell",
+	"dash":    "Shell",
+	"ksh":     "Shell",
+	"lua":     "Lua",
+	"node":    "JavaScript",
+	"perl":    "Perl",
+	"php":     "PHP",
+	"python":  "Python",
+	"python2": "Python",
+	"python3": "Python",
+	"ruby":    "Ruby",
+	"sh":      "Shell",
+	"zsh":     "Shell",
+}
+
+// The lower cased names of every language that files can be in.
+var knownLanguages = func() map[string]bool {
+	langs := map[string]bool{}
+	for _, m := range []map[string]string{languagesByFilename, languagesByExtension, languagesByInterpreter} {
+		for _, lang := range m {
+			langs[strings.ToLower(lang)] = true
+		}
+	}
+	return langs
+}()
+
+// Check that lang, ignoring case, is a language that files can be in.
+func ValidateLanguage(lang string) error {
+	if !knownLanguages[strings.ToLower(lang)] {
+		return fmt.Errorf("unknown language %q", lang)
+	}
+	return nil
+}
+
+// The language of the file with the given name, judged
+// by its name, then its extension, then the shebang line at the start of
+// head. Returns "" if the language isn't known.
+func languageFor(name string, head []byte) string {
+	base := path.Base(filepath.ToSlash(name))
+	if lang, ok := languagesByFilename[base]; ok {
+		return lang
+	}
+
+	if lang, ok := languagesByExtension[strings.ToLower(path.Ext(base))]; ok {
+		return lang
+	}
+
+	return languageForShebang(head)
+}
+
+// Both #!/usr/bin/python3 and #!/usr/bin/env python3 name python3 as the
+// interpreter.
+func languageForShebang(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		// Skip over any options given to env, like -S.
+		interp = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interp = path.Base(f)
+				break
+			}
+		}
+	}
+
+	return languagesByInterpreter[interp]
+}
+
+// How much of a repo is written in a language.
+type LanguageStats struct {
+	Files int
+	Bytes int64
+}
@@ -0,0 +1,129 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLanguageFor(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		lang string
+	}{
+		{"main.go", "", "Go"},
+		{"infra/main.TF", "", "Terraform"},
+		{"lib/foo.jar!/a/Foo.java", "", "Java"},
+		{"Makefile", "", "Makefile"},
+		{"docker/Dockerfile", "#!/bin/sh\n", "Dockerfile"},
+		{"bin/deploy", "#!/usr/bin/env python3\nprint(1)\n", "Python"},
+		{"bin/run", "#!/usr/bin/env -S bash -e\n", "Shell"},
+		{"bin/build", "#!/bin/bash\n", "Shell"},
+		{"bin/tool", "#!/usr/bin/frob\n", ""},
+		{"LICENSE", "MIT License\n", ""},
+	}
+
+	for _, test := range tests {
+		if got := languageFor(test.name, []byte(test.head)); got != test.lang {
+			t.Errorf("%s: expected %q, got %q", test.name, test.lang, got)
+		}
+	}
+}
+
+func TestLanguageFilter(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"main.go":    "package main\n// deploy\n",
+		"main.tf":    "# deploy\n",
+		"bin/deploy": "#!/bin/sh\necho deploy\n",
+		"NOTES":      "deploy\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ref, err := Build(&IndexOptions{}, t.TempDir(), src, url, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The languages are kept in the manifest.
+	ref, err = Read(ref.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ref.LanguageStats["Go"]; s == nil || s.Files != 1 || s.Bytes != int64(len(files["main.go"])) {
+		t.Fatalf("unexpected stats for Go: %+v", s)
+	}
+	if len(ref.LanguageStats) != 3 {
+		t.Fatalf("expected 3 languages, got %v", ref.LanguageStats)
+	}
+
+	// Each file has its language and classes by ID.
+	if len(ref.Languages) != 3 || len(ref.FileLanguages) != len(files) || len(ref.FileClasses) != len(files) {
+		t.Fatalf("unexpected metadata %v %v %v", ref.Languages, ref.FileLanguages, ref.FileClasses)
+	}
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res, err := idx.Search("deploy", &SearchOptions{Language: "terraform"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 || res.Matches[0].Filename != "main.tf" || res.Matches[0].Language != "Terraform" {
+		t.Fatalf("expected only main.tf, got %+v", res.Matches)
+	}
+
+	res, err = idx.Search("deploy", &SearchOptions{Language: "Shell"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 || res.Matches[0].Filename != filepath.Join("bin", "deploy") {
+		t.Fatalf("expected only bin/deploy, got %+v", res.Matches)
+	}
+
+	res, err = idx.Search("deploy", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 4 {
+		t.Fatalf("expected every file without a language filter, got %d", len(res.Matches))
+	}
+
+	// A language that no file is in finds nothing.
+	res, err = idx.Search("deploy", &SearchOptions{Language: "Rust"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 0 {
+		t.Fatalf("expected no Rust files, got %+v", res.Matches)
+	}
+}
+
+func TestValidateLanguage(t *testing.T) {
+	for _, lang := range []string{"Go", "terraform", "c++", "Shell"} {
+		if err := ValidateLanguage(lang); err != nil {
+			t.Errorf("expected %s to be valid: %s", lang, err)
+		}
+	}
+
+	if err := ValidateLanguage("golang"); err == nil {
+		t.Error("expected an unknown language to be rejected")
+	}
+
+	// Languages are numbered from 1 in the manifest.
+	if len(knownLanguages) > 255 {
+		t.Fatalf("too many languages to number, %d", len(knownLanguages))
+	}
+}
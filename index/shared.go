@@ -0,0 +1,329 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hound-search/hound/codesearch/index"
+)
+
+// Files are gzipped once per distinct content into a directory shared by
+// every index next to this one, and linked into raw/.
+const StoreShared = "shared"
+
+const (
+	// The directory that shared content lives in, next to the index
+	// directories.
+	blobsDirname = "blobs"
+
+	// The sorted list of the sha256 hashes of the content an index links
+	// to.
+	blobListFilename = "blobs.list"
+
+	// Content is written to temporary files in the blobs directory before
+	// it is hashed.
+	blobTmpPrefix = ".tmp-"
+
+	// Temporary files that haven't been written to for this long are left
+	// over from builds that didn't finish.
+	staleTmpAge = time.Hour
+)
+
+// The shared content is kept as blobs/<sha256 of the content>. Each index
+// hard links the blobs into its raw/ directory, so the number of links to
+// a blob is the number of files that have its content, plus one.
+func blobsDirFor(indexDir string) string {
+	return filepath.Join(filepath.Dir(indexDir), blobsDirname)
+}
+
+func blobPath(blobsDir string, sum []byte) string {
+	return filepath.Join(blobsDir, hex.EncodeToString(sum))
+}
+
+type sharedWriter struct {
+	raw    string
+	blobs  string
+	dir    string
+	hashes map[[sha256.Size]byte]bool
+}
+
+func newSharedWriter(dst string) (*sharedWriter, error) {
+	w := &sharedWriter{
+		raw:    filepath.Join(dst, "raw"),
+		blobs:  blobsDirFor(dst),
+		dir:    dst,
+		hashes: map[[sha256.Size]byte]bool{},
+	}
+
+	if err := os.Mkdir(w.raw, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(w.blobs, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// The content of a file is gzipped into a temporary file while it is
+// hashed, then linked to the blob with the same hash.
+type sharedFile struct {
+	w    *sharedWriter
+	name string
+	tmp  *os.File
+	gz   *gzip.Writer
+	sum  hash.Hash
+}
+
+func (w *sharedWriter) create(name string) (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp(w.blobs, blobTmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sharedFile{
+		w:    w,
+		name: name,
+		tmp:  tmp,
+		gz:   gzip.NewWriter(tmp),
+		sum:  sha256.New(),
+	}, nil
+}
+
+func (f *sharedFile) Write(b []byte) (int, error) {
+	f.sum.Write(b) //nolint
+	return f.gz.Write(b)
+}
+
+func (f *sharedFile) Close() error {
+	defer os.Remove(f.tmp.Name())
+
+	if err := f.gz.Close(); err != nil {
+		f.tmp.Close()
+		return err
+	}
+
+	if err := f.tmp.Close(); err != nil {
+		return err
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], f.sum.Sum(nil))
+	f.w.hashes[sum] = true
+
+	dup := filepath.Join(f.w.raw, f.name)
+	if err := os.MkdirAll(filepath.Dir(dup), os.ModePerm); err != nil {
+		return err
+	}
+
+	// A name that is written again replaces the earlier content, like it
+	// does in the files store.
+	if err := os.Remove(dup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Link to the existing blob, or make this content the blob if there
+	// isn't one.
+	blob := blobPath(f.w.blobs, sum[:])
+	for i := 0; ; i++ {
+		err := os.Link(blob, dup)
+		if err == nil || !os.IsNotExist(err) || i > 0 {
+			return err
+		}
+
+		if err := os.Rename(f.tmp.Name(), blob); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *sharedWriter) close() error {
+	sums := make([][]byte, 0, len(w.hashes))
+	for sum := range w.hashes {
+		sum := sum
+		sums = append(sums, sum[:])
+	}
+	sort.Slice(sums, func(i, j int) bool {
+		return bytes.Compare(sums[i], sums[j]) < 0
+	})
+
+	f, err := os.Create(filepath.Join(w.dir, blobListFilename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := bufio.NewWriter(f)
+	for _, sum := range sums {
+		b.Write(sum) //nolint
+	}
+
+	// bufio.Writer keeps the first error, so it is reported here.
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// The content of an index in the shared store is read from its raw/ links
+// like the files store, the list of hashes is kept to look up content.
+type sharedReader struct {
+	filesReader
+	hashes    []byte
+	closeList func() error
+}
+
+func openShared(dir string) (*sharedReader, error) {
+	hashes, closeList, err := index.Mmap(filepath.Join(dir, blobListFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hashes)%sha256.Size != 0 {
+		closeList()
+		return nil, fmt.Errorf("corrupt %s", filepath.Join(dir, blobListFilename))
+	}
+
+	return &sharedReader{
+		filesReader: filesReader{dir: filepath.Join(dir, "raw")},
+		hashes:      hashes,
+		closeList:   closeList,
+	}, nil
+}
+
+func (r *sharedReader) has(sum []byte) bool {
+	n := len(r.hashes) / sha256.Size
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(r.hashes[i*sha256.Size:(i+1)*sha256.Size], sum) >= 0
+	})
+	return i < n && bytes.Equal(r.hashes[i*sha256.Size:(i+1)*sha256.Size], sum)
+}
+
+func (r *sharedReader) close() error {
+	return r.closeList()
+}
+
+// Remove the index in dir along with the blobs that no other index links
+// to.
+func removeShared(dir string) error {
+	list, err := os.ReadFile(filepath.Join(dir, blobListFilename))
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	blobs := blobsDirFor(dir)
+	for i := 0; i+sha256.Size <= len(list); i += sha256.Size {
+		blob := blobPath(blobs, list[i:i+sha256.Size])
+		fi, err := os.Stat(blob)
+		if err != nil {
+			continue
+		}
+
+		if n, ok := linkCount(fi); ok && n == 1 {
+			if err := os.Remove(blob); err != nil {
+				log.Printf("failed to remove unused blob %s: %s", blob, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SweepShared removes what is left behind in the shared store of dbpath:
+// the temporary files of builds that didn't finish, and blobs that no index
+// lists. Removing blobs only loses sharing for the indexes built after
+// this, since each index has its own links to its content.
+func SweepShared(dbpath string) error {
+	blobs := filepath.Join(dbpath, blobsDirname)
+	entries, err := os.ReadDir(blobs)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	lists, err := filepath.Glob(filepath.Join(dbpath, "*", blobListFilename))
+	if err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	for _, name := range lists {
+		list, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i+sha256.Size <= len(list); i += sha256.Size {
+			used[hex.EncodeToString(list[i:i+sha256.Size])] = true
+		}
+	}
+
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(e.Name(), blobTmpPrefix) {
+			// A build might still be writing to it.
+			if time.Since(fi.ModTime()) < staleTmpAge {
+				continue
+			}
+		} else if used[e.Name()] {
+			continue
+		} else if n, ok := linkCount(fi); ok && n > 1 {
+			// Linked by an index that is being built.
+			continue
+		}
+
+		blob := filepath.Join(blobs, e.Name())
+		if err := os.Remove(blob); err != nil {
+			log.Printf("failed to remove unused blob %s: %s", blob, err)
+		}
+	}
+
+	return nil
+}
+
+// The sha256 of content as it is stored in the shared store, or "" if the
+// index isn't in the shared store.
+func (n *Index) contentHash(content []byte) string {
+	if _, ok := n.content.(*sharedReader); !ok {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// HasContent tells whether any file in the index has the content with the
+// given hash, as found in FileMatch.ContentHash. Always false for indexes
+// that aren't in the shared store.
+func (n *Index) HasContent(contentHash string) bool {
+	sum, err := hex.DecodeString(contentHash)
+	if err != nil || len(sum) != sha256.Size {
+		return false
+	}
+
+	n.lck.RLock()
+	defer n.lck.RUnlock()
+
+	r, ok := n.content.(*sharedReader)
+	return ok && r.has(sum)
+}
@@ -0,0 +1,624 @@
+package saved
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hound-search/hound/auth"
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+)
+
+const (
+	stateFilename = "saved-searches.json"
+
+	// How many matches of a saved search are kept for each repo. Changes
+	// aren't reported while a search has more, since it can't be told
+	// which of them changed.
+	maxMatches = 1000
+
+	// How many notifications are kept while the webhook can't be reached.
+	// The oldest are dropped beyond these.
+	maxPending = 1000
+
+	maxRetryDelay = 5 * time.Minute
+)
+
+// How long to wait before sending a notification again, which doubles up
+// to maxRetryDelay while the webhook keeps failing.
+var retryDelay = time.Second
+
+// A search that is run again each time one of its repos is reindexed.
+type Search struct {
+	Name  string
+	Query string
+
+	// A comma separated list of repos, all repos when empty or "*".
+	Repos         string `json:",omitempty"`
+	IgnoreCase    bool   `json:",omitempty"`
+	LiteralSearch bool   `json:",omitempty"`
+	Files         string `json:",omitempty"`
+	ExcludeFiles  string `json:",omitempty"`
+
+	// Who saved the search, nil if they weren't authenticated. The search
+	// only runs against the repos they can access, and only they can see
+	// or remove it.
+	Owner *auth.Identity `json:",omitempty"`
+}
+
+// Validate checks that the search has a name and a pattern that compiles.
+func (s *Search) Validate() error {
+	if s.Name == "" {
+		return errors.New("saved searches need a name")
+	}
+
+	if s.Query == "" {
+		return errors.New("saved searches need a query")
+	}
+
+	_, err := index.QueryPlan(s.Query, s.options())
+	return err
+}
+
+func (s *Search) options() *index.SearchOptions {
+	return &index.SearchOptions{
+		IgnoreCase:        s.IgnoreCase,
+		LiteralSearch:     s.LiteralSearch,
+		FileRegexp:        s.Files,
+		ExcludeFileRegexp: s.ExcludeFiles,
+
+		// One more than is kept, to tell when there are too many.
+		MaxResults: maxMatches + 1,
+	}
+}
+
+// Does the search run against the repo? The owner must be able to access
+// it, as they could when the search was saved.
+func (s *Search) includes(name string, repo *config.Repo) bool {
+	if repo == nil || !s.Owner.CanAccess(repo) {
+		return false
+	}
+
+	if s.Repos == "" || s.Repos == "*" {
+		return true
+	}
+
+	for _, r := range strings.Split(s.Repos, ",") {
+		if strings.TrimSpace(r) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Searches are kept by owner and name, so that everyone has their own
+// names.
+func keyOf(name string, owner *auth.Identity) string {
+	var user string
+	if owner != nil {
+		user = owner.User
+	}
+	return user + "\x00" + name
+}
+
+func (s *Search) key() string {
+	return keyOf(s.Name, s.Owner)
+}
+
+// Was the search saved by the caller with the given identity?
+func (s *Search) ownedBy(id *auth.Identity) bool {
+	if s.Owner == nil || id == nil {
+		return s.Owner == nil && id == nil
+	}
+	return s.Owner.User == id.User
+}
+
+// A matching line. Matches are told apart by their file and the contents
+// of the line, so that lines that only move aren't reported.
+type Match struct {
+	Filename   string
+	LineNumber int
+	Line       string
+}
+
+func (m *Match) key() string {
+	return m.Filename + "\x00" + m.Line
+}
+
+// The matches of a search in a repo, as of a revision. Truncated results
+// had too many matches to keep.
+type result struct {
+	Revision  string
+	Matches   []*Match
+	Truncated bool `json:",omitempty"`
+}
+
+// What is kept in the dbpath. Searches and their results are keyed by
+// owner and name, see keyOf.
+type state struct {
+	Searches map[string]*Search
+
+	// The results of each search in each repo when they were last run.
+	Results map[string]map[string]*result
+
+	// The notifications that are yet to be delivered, oldest first.
+	Pending []*Notification `json:",omitempty"`
+}
+
+// The parts of a searcher.Searcher that saved searches use.
+type Searcher interface {
+	Search(pat string, opt *index.SearchOptions) (*index.SearchResponse, error)
+	OnReindex(fn func())
+}
+
+// Store keeps the saved searches and runs them against repos as they are
+// reindexed. A nil Store has no saved searches.
+type Store struct {
+	file    string
+	webhook *webhook
+
+	lck     sync.Mutex
+	state   state
+	repos   map[string]Searcher
+	configs map[string]*config.Repo
+
+	// Held while searches are run, so that results are diffed one at a
+	// time.
+	runLck sync.Mutex
+
+	// Tracks the searches that are run in the background, so that Close
+	// can wait for them. No more are run once closed is set.
+	wg     sync.WaitGroup
+	closed bool
+
+	// Runs each search, see SetLimiter.
+	limit Limiter
+
+	// Notifications are delivered in the background, so that a slow
+	// webhook doesn't hold up searches. wake is signalled when they are
+	// queued, closing done stops the delivery and stopped is closed once
+	// it has.
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// A Limiter runs fn once there is room for another search, returning false
+// without running it if there isn't room soon enough.
+type Limiter func(fn func()) bool
+
+// SetLimiter makes saved searches wait their turn along with other
+// searches. Searches that are turned away are run again the next time
+// their repo is reindexed.
+func (s *Store) SetLimiter(limit Limiter) {
+	if s == nil {
+		return
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.limit = limit
+}
+
+// Open the saved searches in dbpath, returning nil if they aren't
+// configured.
+func Open(cfg *config.SavedSearchConfig, dbpath string) (*Store, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	s := &Store{
+		file:    filepath.Join(dbpath, stateFilename),
+		webhook: newWebhook(cfg),
+		state: state{
+			Searches: map[string]*Search{},
+			Results:  map[string]map[string]*result{},
+		},
+		repos:   map[string]Searcher{},
+		configs: map[string]*config.Repo{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	b, err := ioutil.ReadFile(s.file)
+	if err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, fmt.Errorf("corrupt %s: %s", s.file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if s.state.Searches == nil {
+		s.state.Searches = map[string]*Search{}
+	}
+	if s.state.Results == nil {
+		s.state.Results = map[string]map[string]*result{}
+	}
+
+	go s.deliver()
+
+	return s, nil
+}
+
+// Send the pending notifications to the webhook in order, trying each
+// again until it is delivered.
+func (s *Store) deliver() {
+	defer close(s.stopped)
+
+	delay := retryDelay
+	for {
+		var n *Notification
+		s.lck.Lock()
+		if len(s.state.Pending) > 0 {
+			n = s.state.Pending[0]
+		}
+		s.lck.Unlock()
+
+		if n == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		if err := s.webhook.send(n); err != nil {
+			log.Printf("failed to notify of changes to saved search %s on %s, trying again in %s: %s", n.Search, n.Repo, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return
+			}
+
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+		delay = retryDelay
+
+		s.lck.Lock()
+		// It may have been dropped to make room in the meantime.
+		if len(s.state.Pending) > 0 && s.state.Pending[0] == n {
+			s.state.Pending = s.state.Pending[1:]
+		}
+		if err := s.save(); err != nil {
+			log.Printf("failed to save %s: %s", s.file, err)
+		}
+		s.lck.Unlock()
+	}
+}
+
+// Queue the notification to be delivered. The caller must hold lck.
+func (s *Store) notify(n *Notification) {
+	if len(s.state.Pending) >= maxPending {
+		dropped := s.state.Pending[0]
+		log.Printf("too many undelivered notifications, dropping the one for saved search %s on %s", dropped.Search, dropped.Repo)
+		s.state.Pending = s.state.Pending[1:]
+	}
+	s.state.Pending = append(s.state.Pending, n)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Write the state to a temporary file that then replaces the old one, so
+// that it is never left half written. The caller must hold lck.
+func (s *Store) save() error {
+	b, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.file), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// List the saved searches of the caller with the given identity by name.
+func (s *Store) List(id *auth.Identity) []*Search {
+	if s == nil {
+		return nil
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	searches := []*Search{}
+	for _, search := range s.state.Searches {
+		if search.ownedBy(id) {
+			searches = append(searches, search)
+		}
+	}
+	sort.Slice(searches, func(i, j int) bool {
+		return searches[i].Name < searches[j].Name
+	})
+	return searches
+}
+
+// Add the search, replacing any of its owner's with the same name. Its
+// results in the watched repos are found straight away, so that later
+// changes to them can be reported.
+func (s *Store) Add(search *Search) error {
+	if s == nil {
+		return errors.New("saved searches are not configured")
+	}
+
+	if err := search.Validate(); err != nil {
+		return err
+	}
+
+	s.runLck.Lock()
+	defer s.runLck.Unlock()
+
+	s.lck.Lock()
+	s.state.Searches[search.key()] = search
+	delete(s.state.Results, search.key())
+	repos := map[string]Searcher{}
+	for name, srch := range s.repos {
+		if search.includes(name, s.configs[name]) {
+			repos[name] = srch
+		}
+	}
+	s.lck.Unlock()
+
+	for name, srch := range repos {
+		s.runOne(search, name, srch)
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.save()
+}
+
+// Remove the search with the given name that the caller with the given
+// identity saved. Returns false if they don't have one.
+func (s *Store) Remove(name string, id *auth.Identity) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	key := keyOf(name, id)
+	if search, ok := s.state.Searches[key]; !ok || !search.ownedBy(id) {
+		return false, nil
+	}
+
+	delete(s.state.Searches, key)
+	delete(s.state.Results, key)
+	return true, s.save()
+}
+
+// Watch runs the saved searches against the repo each time it is
+// reindexed. They are also run once in the background now, to catch up on
+// changes made while Hound wasn't running. The repo's config decides whose
+// searches it is included in.
+func (s *Store) Watch(repo string, cfg *config.Repo, srch Searcher) {
+	if s == nil {
+		return
+	}
+
+	s.lck.Lock()
+	if s.closed {
+		s.lck.Unlock()
+		return
+	}
+	s.repos[repo] = srch
+	s.configs[repo] = cfg
+	s.wg.Add(1)
+	s.lck.Unlock()
+
+	srch.OnReindex(func() {
+		s.Run(repo)
+	})
+
+	go func() {
+		defer s.wg.Done()
+		s.Run(repo)
+	}()
+}
+
+// Close stops running saved searches and waits for the ones that are
+// running in the background to finish, after which the searchers that are
+// watched can be closed. Notifications that are yet to be delivered are
+// kept for the next time the store is opened.
+func (s *Store) Close() {
+	if s == nil {
+		return
+	}
+
+	s.lck.Lock()
+	if s.closed {
+		s.lck.Unlock()
+		return
+	}
+	s.closed = true
+	s.lck.Unlock()
+
+	s.wg.Wait()
+
+	close(s.done)
+	<-s.stopped
+}
+
+// Run the saved searches against the current index of the repo, sending
+// the changes in their results to the webhook.
+func (s *Store) Run(repo string) {
+	s.runLck.Lock()
+	defer s.runLck.Unlock()
+
+	s.lck.Lock()
+	if s.closed {
+		s.lck.Unlock()
+		return
+	}
+	srch := s.repos[repo]
+	var searches []*Search
+	for _, search := range s.state.Searches {
+		if search.includes(repo, s.configs[repo]) {
+			searches = append(searches, search)
+		}
+	}
+	s.lck.Unlock()
+
+	if srch == nil || len(searches) == 0 {
+		return
+	}
+
+	for _, search := range searches {
+		s.runOne(search, repo, srch)
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if err := s.save(); err != nil {
+		log.Printf("failed to save %s: %s", s.file, err)
+	}
+}
+
+// Run the search against the repo and queue a notification of how its
+// results changed since it was last run. The caller must hold runLck.
+func (s *Store) runOne(search *Search, repo string, srch Searcher) {
+	s.lck.Lock()
+	limit := s.limit
+	s.lck.Unlock()
+
+	var res *index.SearchResponse
+	var err error
+	run := func() {
+		res, err = srch.Search(search.Query, search.options())
+	}
+
+	if limit == nil {
+		run()
+	} else if !limit(run) {
+		log.Printf("too many searches to run saved search %s on %s, will try again on the next update", search.Name, repo)
+		return
+	}
+
+	if err != nil {
+		log.Printf("failed to run saved search %s on %s: %s", search.Name, repo, err)
+		return
+	}
+
+	s.lck.Lock()
+	prev := s.state.Results[search.key()][repo]
+	s.lck.Unlock()
+
+	if prev != nil && prev.Revision == res.Revision {
+		return
+	}
+
+	cur := &result{
+		Revision: res.Revision,
+		Matches:  matchesOf(res),
+	}
+	if len(cur.Matches) > maxMatches {
+		cur.Matches = nil
+		cur.Truncated = true
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	// The search may have been removed or replaced in the meantime.
+	if s.state.Searches[search.key()] != search {
+		return
+	}
+
+	// The first results of a search are what later ones are compared to,
+	// and results with too many matches can't be compared. The webhook is
+	// told when a search first has too many.
+	switch {
+	case prev == nil:
+	case cur.Truncated && !prev.Truncated:
+		s.notify(&Notification{
+			Search:    search.Name,
+			Query:     search.Query,
+			Repo:      repo,
+			Revision:  res.Revision,
+			Truncated: true,
+		})
+	case cur.Truncated || prev.Truncated:
+	default:
+		added, removed := diff(prev.Matches, cur.Matches)
+		if len(added) > 0 || len(removed) > 0 {
+			s.notify(&Notification{
+				Search:   search.Name,
+				Query:    search.Query,
+				Repo:     repo,
+				Revision: res.Revision,
+				Added:    added,
+				Removed:  removed,
+			})
+		}
+	}
+
+	results := s.state.Results[search.key()]
+	if results == nil {
+		results = map[string]*result{}
+		s.state.Results[search.key()] = results
+	}
+	results[repo] = cur
+}
+
+func matchesOf(res *index.SearchResponse) []*Match {
+	var matches []*Match
+	for _, fm := range res.Matches {
+		for _, m := range fm.Matches {
+			matches = append(matches, &Match{
+				Filename:   fm.Filename,
+				LineNumber: m.LineNumber,
+				Line:       m.Line,
+			})
+		}
+	}
+	return matches
+}
+
+// The matches in cur that aren't in prev, and the ones in prev that aren't
+// in cur.
+func diff(prev, cur []*Match) (added, removed []*Match) {
+	inPrev := map[string]bool{}
+	for _, m := range prev {
+		inPrev[m.key()] = true
+	}
+
+	inCur := map[string]bool{}
+	for _, m := range cur {
+		inCur[m.key()] = true
+		if !inPrev[m.key()] {
+			added = append(added, m)
+		}
+	}
+
+	for _, m := range prev {
+		if !inCur[m.key()] {
+			removed = append(removed, m)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,494 @@
+package saved
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/auth"
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/index"
+)
+
+// A searcher that returns the lines it is given for every search.
+type fakeSearcher struct {
+	lck   sync.Mutex
+	rev   string
+	lines map[string][]string
+	hooks []func()
+
+	// When set, searches start by signalling started and then wait for
+	// block to be closed.
+	started chan struct{}
+	block   chan struct{}
+	count   int
+}
+
+func (f *fakeSearcher) Search(pat string, opt *index.SearchOptions) (*index.SearchResponse, error) {
+	if f.block != nil {
+		f.started <- struct{}{}
+		<-f.block
+	}
+
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	f.count++
+
+	res := &index.SearchResponse{Revision: f.rev}
+	for name, lines := range f.lines {
+		fm := &index.FileMatch{Filename: name}
+		for i, line := range lines {
+			fm.Matches = append(fm.Matches, &index.Match{Line: line, LineNumber: i + 1})
+		}
+		res.Matches = append(res.Matches, fm)
+	}
+	return res, nil
+}
+
+func (f *fakeSearcher) OnReindex(fn func()) {
+	f.hooks = append(f.hooks, fn)
+}
+
+func (f *fakeSearcher) reindex(rev string, lines map[string][]string) {
+	f.lck.Lock()
+	f.rev, f.lines = rev, lines
+	f.lck.Unlock()
+
+	for _, fn := range f.hooks {
+		fn()
+	}
+}
+
+type receiver struct {
+	lck    sync.Mutex
+	status int
+	failed int
+	got    []*Notification
+
+	// When set, requests wait for it to be closed.
+	block chan struct{}
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.block != nil {
+		<-r.block
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get(SignatureHeader) != Sign([]byte("s3cret"), body) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+
+	if r.status != 0 {
+		r.failed++
+		w.WriteHeader(r.status)
+		return
+	}
+
+	var n Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.got = append(r.got, &n)
+}
+
+func (r *receiver) respondWith(status int) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.status = status
+}
+
+func (r *receiver) failures() int {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return r.failed
+}
+
+// Wait for the notifications that are queued to be delivered.
+func waitDelivered(t *testing.T, s *Store) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		s.lck.Lock()
+		n := len(s.state.Pending)
+		s.lck.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for notifications to be delivered")
+}
+
+func (r *receiver) take() []*Notification {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	got := r.got
+	r.got = nil
+	return got
+}
+
+func TestSavedSearches(t *testing.T) {
+	recv := &receiver{}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+
+	cfg := &config.SavedSearchConfig{
+		WebhookUrl: srv.URL,
+		Secret:     "s3cret",
+		TimeoutMs:  5000,
+	}
+	dbpath := t.TempDir()
+
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	s, err := Open(cfg, dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &fakeSearcher{rev: "r1", lines: map[string][]string{"a.go": {"oldAPI()", "oldAPI(1)"}}}
+	s.Watch("repo", &config.Repo{}, repo)
+
+	if err := s.Add(&Search{Name: "old", Query: "oldAPI\\(", Repos: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(&Search{Name: "old", Query: "oldAPI\\("}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(&Search{Name: "bad", Query: "("}); err == nil {
+		t.Fatal("expected an invalid pattern to be rejected")
+	}
+
+	// The first results aren't reported.
+	s.Run("repo")
+	if got := recv.take(); len(got) != 0 {
+		t.Fatalf("expected no notifications, got %d", len(got))
+	}
+
+	// A line that moves isn't reported.
+	repo.reindex("r2", map[string][]string{"a.go": {"oldAPI(1)", "oldAPI(2)"}})
+	waitDelivered(t, s)
+	got := recv.take()
+	if len(got) != 1 {
+		t.Fatalf("expected a notification, got %d", len(got))
+	}
+	n := got[0]
+	if n.Search != "old" || n.Query != "oldAPI\\(" || n.Repo != "repo" || n.Revision != "r2" ||
+		len(n.Added) != 1 || n.Added[0].Line != "oldAPI(2)" || n.Added[0].LineNumber != 2 ||
+		len(n.Removed) != 1 || n.Removed[0].Line != "oldAPI()" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+
+	// Changes that can't be delivered are sent again.
+	recv.respondWith(http.StatusInternalServerError)
+	repo.reindex("r3", map[string][]string{})
+	for recv.failures() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	recv.respondWith(0)
+	waitDelivered(t, s)
+	got = recv.take()
+	if len(got) != 1 || len(got[0].Removed) != 2 || got[0].Revision != "r3" {
+		t.Fatalf("expected the removals to be delivered, got %+v", got)
+	}
+
+	// The searches and their results are kept in the dbpath.
+	s.Close()
+	s, err = Open(cfg, dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := s.List(nil); len(list) != 1 || list[0].Name != "old" {
+		t.Fatalf("unexpected saved searches: %+v", list)
+	}
+	s.repos["repo"] = repo
+	s.configs["repo"] = &config.Repo{}
+	s.Run("repo")
+	if got := recv.take(); len(got) != 0 {
+		t.Fatalf("expected nothing new to report, got %d", len(got))
+	}
+
+	if ok, err := s.Remove("old", nil); !ok || err != nil {
+		t.Fatalf("expected the search to be removed, got %v %v", ok, err)
+	}
+	if ok, _ := s.Remove("old", nil); ok {
+		t.Fatal("expected the search to be gone")
+	}
+	s.Close()
+}
+
+// Results with more matches than are kept aren't compared, since they
+// would report matches as added and removed when they only moved past the
+// limit.
+func TestTruncatedResults(t *testing.T) {
+	recv := &receiver{}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+
+	cfg := &config.SavedSearchConfig{WebhookUrl: srv.URL, Secret: "s3cret", TimeoutMs: 5000}
+	s, err := Open(cfg, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Add(&Search{Name: "a", Query: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := func(n int) map[string][]string {
+		var ls []string
+		for i := 0; i < n; i++ {
+			ls = append(ls, fmt.Sprintf("a%d", i))
+		}
+		return map[string][]string{"a.go": ls}
+	}
+
+	repo := &fakeSearcher{rev: "r1", lines: lines(2)}
+	s.repos["repo"], s.configs["repo"] = repo, &config.Repo{}
+	s.Run("repo")
+
+	run := func(rev string, n int) []*Notification {
+		repo.reindex(rev, lines(n))
+		s.Run("repo")
+		waitDelivered(t, s)
+		return recv.take()
+	}
+
+	got := run("r2", maxMatches+1)
+	if len(got) != 1 || !got[0].Truncated || len(got[0].Added) != 0 || len(got[0].Removed) != 0 {
+		t.Fatalf("expected to be told the results are truncated, got %+v", got)
+	}
+
+	if got := run("r3", maxMatches+2); len(got) != 0 {
+		t.Fatalf("expected truncated results not to be compared, got %+v", got)
+	}
+
+	// Once there are few enough again, they are what is compared to.
+	if got := run("r4", 2); len(got) != 0 {
+		t.Fatalf("expected nothing to be reported, got %+v", got)
+	}
+	if got := run("r5", 3); len(got) != 1 || len(got[0].Added) != 1 || got[0].Truncated {
+		t.Fatalf("expected the added line to be reported, got %+v", got)
+	}
+}
+
+// A webhook that is slow to respond doesn't hold up searches, and gets the
+// notifications that queue up meanwhile in order.
+func TestSlowWebhook(t *testing.T) {
+	recv := &receiver{block: make(chan struct{})}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+
+	cfg := &config.SavedSearchConfig{WebhookUrl: srv.URL, Secret: "s3cret", TimeoutMs: 5000}
+	dbpath := t.TempDir()
+	s, err := Open(cfg, dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(&Search{Name: "a", Query: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &fakeSearcher{rev: "r1", lines: map[string][]string{"a.go": {"a"}}}
+	s.repos["repo"], s.configs["repo"] = repo, &config.Repo{}
+	s.Run("repo")
+
+	done := make(chan struct{})
+	go func() {
+		repo.reindex("r2", map[string][]string{"a.go": {"a", "aa"}})
+		s.Run("repo")
+		repo.reindex("r3", map[string][]string{"a.go": {"a", "aa", "aaa"}})
+		s.Run("repo")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected searches to run while the webhook is slow")
+	}
+
+	s.lck.Lock()
+	pending := len(s.state.Pending)
+	s.lck.Unlock()
+	if pending != 2 {
+		t.Fatalf("expected 2 pending notifications, got %d", pending)
+	}
+
+	close(recv.block)
+	waitDelivered(t, s)
+	got := recv.take()
+	if len(got) != 2 || got[0].Revision != "r2" || got[1].Revision != "r3" {
+		t.Fatalf("expected the notifications in order, got %+v", got)
+	}
+	s.Close()
+}
+
+// Saved searches only run against the repos that their owner can access,
+// and only the owner can see or remove them.
+func TestSavedSearchAccess(t *testing.T) {
+	s, err := Open(&config.SavedSearchConfig{WebhookUrl: "http://127.0.0.1:0", TimeoutMs: 100}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	open := &fakeSearcher{}
+	payments := &fakeSearcher{}
+	s.repos["open"], s.configs["open"] = open, &config.Repo{}
+	s.repos["payments"], s.configs["payments"] = payments, &config.Repo{AllowedGroups: []string{"payments"}}
+
+	alice := &auth.Identity{User: "alice", Groups: []string{"payments"}}
+	bob := &auth.Identity{User: "bob"}
+
+	if err := s.Add(&Search{Name: "a", Query: "a", Owner: alice}); err != nil {
+		t.Fatal(err)
+	}
+	if open.count != 1 || payments.count != 1 {
+		t.Fatalf("expected alice's search to run on both repos, got %d %d", open.count, payments.count)
+	}
+
+	if err := s.Add(&Search{Name: "b", Query: "b", Owner: bob}); err != nil {
+		t.Fatal(err)
+	}
+	if open.count != 2 || payments.count != 1 {
+		t.Fatalf("expected bob's search to only run on the open repo, got %d %d", open.count, payments.count)
+	}
+
+	s.Run("payments")
+	if payments.count != 2 {
+		t.Fatalf("expected only alice's search to run on reindex, got %d", payments.count)
+	}
+
+	if list := s.List(bob); len(list) != 1 || list[0].Name != "b" {
+		t.Fatalf("expected bob to only see his search, got %+v", list)
+	}
+	if list := s.List(nil); len(list) != 0 {
+		t.Fatalf("expected anonymous callers to see nothing, got %+v", list)
+	}
+
+	// Names are only unique to their owner.
+	if err := s.Add(&Search{Name: "a", Query: "b", Owner: bob}); err != nil {
+		t.Fatal(err)
+	}
+	if list := s.List(alice); len(list) != 1 || list[0].Query != "a" {
+		t.Fatalf("expected alice's search to be left as it was, got %+v", list)
+	}
+	if list := s.List(bob); len(list) != 2 || list[0].Query != "b" {
+		t.Fatalf("expected bob to have his own search a, got %+v", list)
+	}
+
+	if ok, err := s.Remove("a", bob); !ok || err != nil {
+		t.Fatalf("expected bob to remove his search, got %v %v", ok, err)
+	}
+	if ok, err := s.Remove("a", alice); !ok || err != nil {
+		t.Fatalf("expected alice to remove her search, got %v %v", ok, err)
+	}
+	if ok, _ := s.Remove("a", alice); ok {
+		t.Fatal("expected alice's search to be gone")
+	}
+}
+
+// The searches run in the background when a repo is first watched must
+// finish before the searchers they use are closed.
+func TestCloseWaitsForSearches(t *testing.T) {
+	s, err := Open(&config.SavedSearchConfig{WebhookUrl: "http://127.0.0.1:0", TimeoutMs: 100}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(&Search{Name: "a", Query: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &fakeSearcher{
+		started: make(chan struct{}),
+		block:   make(chan struct{}),
+	}
+	s.Watch("repo", &config.Repo{}, repo)
+	<-repo.started
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the running search")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(repo.block)
+	<-closed
+
+	// Nothing more is run once closed.
+	repo.block = nil
+	s.Run("repo")
+	s.Watch("other", &config.Repo{}, repo)
+	if repo.count != 1 {
+		t.Fatalf("expected a single search, got %d", repo.count)
+	}
+}
+
+// Saved searches that are turned away by the limiter are run again on the
+// next update.
+func TestLimiter(t *testing.T) {
+	s, err := Open(&config.SavedSearchConfig{WebhookUrl: "http://127.0.0.1:0", TimeoutMs: 100}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Add(&Search{Name: "a", Query: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	admit := false
+	s.SetLimiter(func(fn func()) bool {
+		if admit {
+			fn()
+		}
+		return admit
+	})
+
+	repo := &fakeSearcher{}
+	s.repos["repo"] = repo
+	s.configs["repo"] = &config.Repo{}
+	s.Run("repo")
+	if repo.count != 0 {
+		t.Fatalf("expected the search to be turned away, got %d searches", repo.count)
+	}
+
+	admit = true
+	s.Run("repo")
+	if repo.count != 1 {
+		t.Fatalf("expected the search to run, got %d searches", repo.count)
+	}
+}
+
+func TestNotConfigured(t *testing.T) {
+	s, err := Open(nil, t.TempDir())
+	if err != nil || s != nil {
+		t.Fatalf("expected no store, got %v %v", s, err)
+	}
+
+	s.Watch("repo", &config.Repo{}, &fakeSearcher{})
+	s.SetLimiter(nil)
+	if s.List(nil) != nil {
+		t.Fatal("expected no saved searches")
+	}
+	if err := s.Add(&Search{Name: "a", Query: "a"}); err == nil {
+		t.Fatal("expected adding to fail")
+	}
+	s.Close()
+}
@@ -0,0 +1,82 @@
+package saved
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+// The header holding the signature of a notification, which is the hex
+// encoded HMAC-SHA256 of the body keyed with the configured secret.
+const SignatureHeader = "X-Hound-Signature-256"
+
+// What is posted to the webhook when the results of a saved search change
+// in a repo. Only the name and query of the search are sent, not who saved
+// it.
+type Notification struct {
+	Search   string
+	Query    string
+	Repo     string
+	Revision string
+	Added    []*Match `json:",omitempty"`
+	Removed  []*Match `json:",omitempty"`
+
+	// The search now has more matches than are compared, so changes to
+	// them aren't reported until it has fewer again.
+	Truncated bool `json:",omitempty"`
+}
+
+type webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhook(cfg *config.SavedSearchConfig) *webhook {
+	return &webhook{
+		url:    cfg.WebhookUrl,
+		secret: []byte(cfg.Secret),
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		},
+	}
+}
+
+// Sign the body of a notification.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body) //nolint
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhook) send(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.secret, body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
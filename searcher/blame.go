@@ -0,0 +1,108 @@
+package searcher
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/vcs"
+)
+
+const (
+	// How many files are blamed for each search of a repo. Matches in the
+	// files after these are left without blame.
+	maxBlameFiles = 25
+
+	// How many blamed files are kept for each repo. Once full, the cache
+	// starts over.
+	maxCachedBlames = 1000
+)
+
+// The blame of files at the revision of the current index. Files that
+// can't be blamed are cached as nil.
+type blameCache struct {
+	lck   sync.Mutex
+	rev   string
+	files map[string][]*vcs.BlameLine
+}
+
+func (c *blameCache) get(rev, name string) ([]*vcs.BlameLine, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if c.rev != rev {
+		return nil, false
+	}
+	lines, ok := c.files[name]
+	return lines, ok
+}
+
+func (c *blameCache) add(rev, name string, lines []*vcs.BlameLine) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if c.files == nil || c.rev != rev || len(c.files) >= maxCachedBlames {
+		c.rev = rev
+		c.files = map[string][]*vcs.BlameLine{}
+	}
+	c.files[name] = lines
+}
+
+func (s *Searcher) blameFile(rev, name string) []*vcs.BlameLine {
+	if lines, ok := s.blames.get(rev, name); ok {
+		return lines
+	}
+
+	lines, err := s.wd.Blame(s.vcsDir, rev, name)
+	if err != nil {
+		log.Printf("failed to blame %s in %s: %s", name, s.name, err)
+	}
+	s.blames.add(rev, name, lines)
+	return lines
+}
+
+// Blame returns a copy of the results with who last changed each matching
+// line and when, as far as the repo's vcs can tell. Only the first
+// maxBlameFiles files are blamed. Files from submodules and archives are
+// never blamed.
+func (s *Searcher) Blame(res *index.SearchResponse) *index.SearchResponse {
+	if s.wd == nil || len(res.Matches) == 0 {
+		return res
+	}
+
+	s.wdLck.RLock()
+	defer s.wdLck.RUnlock()
+
+	cp := *res
+	cp.Matches = make([]*index.FileMatch, len(res.Matches))
+	for i, fm := range res.Matches {
+		cp.Matches[i] = fm
+		if i >= maxBlameFiles || fm.Submodule != nil || index.IsArchiveMember(fm.Filename) {
+			continue
+		}
+
+		lines := s.blameFile(res.Revision, fm.Filename)
+		if lines == nil {
+			continue
+		}
+
+		f := *fm
+		f.Matches = make([]*index.Match, len(fm.Matches))
+		for j, m := range fm.Matches {
+			f.Matches[j] = m
+			if m.LineNumber < 1 || m.LineNumber > len(lines) || lines[m.LineNumber-1] == nil {
+				continue
+			}
+
+			b := lines[m.LineNumber-1]
+			date := b.Date
+			bm := *m
+			bm.Author = b.Author
+			bm.Commit = b.Commit
+			bm.Date = &date
+			f.Matches[j] = &bm
+		}
+		cp.Matches[i] = &f
+	}
+	return &cp
+}
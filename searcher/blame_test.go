@@ -0,0 +1,108 @@
+package searcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/index"
+	"github.com/hound-search/hound/vcs"
+)
+
+// A driver that blames every line on the same commit, counting the files
+// that it is asked about.
+type blameDriver struct {
+	vcs.Driver
+	calls int
+}
+
+func (d *blameDriver) Blame(dir, rev, path string) ([]*vcs.BlameLine, error) {
+	d.calls++
+	return []*vcs.BlameLine{
+		nil,
+		{Author: "Ann <ann@example.com>", Commit: rev, Date: time.Unix(0, 0)},
+	}, nil
+}
+
+func TestBlame(t *testing.T) {
+	d := &blameDriver{}
+	s := &Searcher{name: "r", wd: &vcs.WorkDir{Driver: d}}
+
+	res := &index.SearchResponse{
+		Revision: "abc",
+		Matches: []*index.FileMatch{
+			{Filename: "a.go", Matches: []*index.Match{{LineNumber: 1}, {LineNumber: 2}, {LineNumber: 9}}},
+			{Filename: "lib/foo.jar!/a.txt", Matches: []*index.Match{{LineNumber: 2}}},
+		},
+	}
+
+	blamed := s.Blame(res)
+	if res.Matches[0].Matches[1].Author != "" {
+		t.Fatal("expected the results to be copied")
+	}
+
+	ms := blamed.Matches[0].Matches
+	if ms[0].Author != "" || ms[2].Author != "" {
+		t.Errorf("expected lines without blame to be left alone, got %+v %+v", ms[0], ms[2])
+	}
+	if ms[1].Author != "Ann <ann@example.com>" || ms[1].Commit != "abc" || ms[1].Date == nil {
+		t.Errorf("unexpected blame: %+v", ms[1])
+	}
+	if blamed.Matches[1].Matches[0].Author != "" {
+		t.Error("expected archive members not to be blamed")
+	}
+
+	// The blame is cached for the revision.
+	s.Blame(res)
+	if d.calls != 1 {
+		t.Errorf("expected 1 blame, got %d", d.calls)
+	}
+
+	res.Revision = "def"
+	s.Blame(res)
+	if d.calls != 2 {
+		t.Errorf("expected a new revision to be blamed again, got %d blames", d.calls)
+	}
+}
+
+func TestBlameUnsupported(t *testing.T) {
+	s := &Searcher{name: "r", wd: &vcs.WorkDir{Driver: &vcs.MercurialDriver{}}}
+
+	res := &index.SearchResponse{
+		Matches: []*index.FileMatch{
+			{Filename: "a.go", Matches: []*index.Match{{LineNumber: 1}}},
+		},
+	}
+	if blamed := s.Blame(res); blamed.Matches[0].Matches[0].Author != "" {
+		t.Errorf("expected no blame, got %+v", blamed.Matches[0].Matches[0])
+	}
+}
+
+// Blame doesn't read the working directory while it is being updated.
+func TestBlameWaitsForUpdate(t *testing.T) {
+	d := &blameDriver{}
+	s := &Searcher{name: "r", wd: &vcs.WorkDir{Driver: d}}
+
+	res := &index.SearchResponse{
+		Revision: "abc",
+		Matches: []*index.FileMatch{
+			{Filename: "a.go", Matches: []*index.Match{{LineNumber: 2}}},
+		},
+	}
+
+	s.wdLck.Lock()
+	done := make(chan *index.SearchResponse)
+	go func() {
+		done <- s.Blame(res)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected blame to wait for the update")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.wdLck.Unlock()
+	if blamed := <-done; blamed.Matches[0].Matches[0].Author == "" {
+		t.Fatal("expected the line to be blamed after the update")
+	}
+}
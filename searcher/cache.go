@@ -0,0 +1,206 @@
+package searcher
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hound-search/hound/index"
+)
+
+// Hits and misses of the result cache for a repo, along with the results it
+// holds for the repo.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+type cacheKey struct {
+	repo    string
+	rev     string
+	pattern string
+	opt     index.SearchOptions
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	res  *index.SearchResponse
+	size int64
+}
+
+// A least recently used cache of search results shared by all searchers,
+// holding roughly maxBytes worth of results. A nil Cache caches nothing.
+type Cache struct {
+	maxBytes int64
+
+	lck   sync.Mutex
+	bytes int64
+	lru   *list.List
+	items map[cacheKey]*list.Element
+	stats map[string]*CacheStats
+}
+
+// Returns nil if maxBytes is not positive.
+func NewCache(maxBytes int64) *Cache {
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	return &Cache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[cacheKey]*list.Element{},
+		stats:    map[string]*CacheStats{},
+	}
+}
+
+// The key for a search on a revision of a repo. Returns false if the
+// search can't be cached.
+func keyFor(repo, rev, pat string, opt *index.SearchOptions) (cacheKey, bool) {
+	pattern, err := index.NormalizePattern(pat, opt)
+	if err != nil {
+		return cacheKey{}, false
+	}
+
+	key := cacheKey{
+		repo:    repo,
+		rev:     rev,
+		pattern: pattern,
+		opt:     *opt,
+	}
+
+	// These are part of the normalized pattern.
+	key.opt.IgnoreCase = false
+	key.opt.LiteralSearch = false
+
+	return key, true
+}
+
+// A rough estimate of the memory held by a response.
+func sizeOf(res *index.SearchResponse) int64 {
+	n := int64(128 + len(res.Revision))
+	for _, fm := range res.Matches {
+		n += int64(96 + len(fm.Filename))
+		for _, m := range fm.Matches {
+			n += int64(96 + len(m.Line))
+			for _, l := range m.Before {
+				n += int64(16 + len(l))
+			}
+			for _, l := range m.After {
+				n += int64(16 + len(l))
+			}
+		}
+	}
+	for _, c := range res.Commits {
+		n += int64(128 + len(c.Hash) + len(c.Author) + len(c.Message))
+		for _, f := range c.Files {
+			n += int64(48 + len(f.Path))
+			for _, h := range f.Hunks {
+				n += int64(48 + len(h.Header))
+				for _, l := range h.Lines {
+					n += int64(16 + len(l))
+				}
+			}
+		}
+	}
+	return n
+}
+
+func (c *Cache) statsFor(repo string) *CacheStats {
+	s := c.stats[repo]
+	if s == nil {
+		s = &CacheStats{}
+		c.stats[repo] = s
+	}
+	return s
+}
+
+func (c *Cache) get(key cacheKey) (*index.SearchResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		c.statsFor(key.repo).Misses++
+		return nil, false
+	}
+
+	c.statsFor(key.repo).Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).res, true
+}
+
+func (c *Cache) removeElement(e *list.Element) {
+	ent := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, ent.key)
+	c.bytes -= ent.size
+
+	s := c.statsFor(ent.key.repo)
+	s.Entries--
+	s.Bytes -= ent.size
+}
+
+func (c *Cache) add(key cacheKey, res *index.SearchResponse) {
+	if c == nil {
+		return
+	}
+
+	size := sizeOf(res)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+
+	for c.bytes+size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheEntry{key, res, size})
+	c.bytes += size
+
+	s := c.statsFor(key.repo)
+	s.Entries++
+	s.Bytes += size
+}
+
+// Drop the results for a repo, like when it gets a new index.
+func (c *Cache) removeRepo(repo string) {
+	if c == nil {
+		return
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cacheEntry).key.repo == repo {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+// The stats for a repo, or nil if nothing is cached.
+func (c *Cache) Stats(repo string) *CacheStats {
+	if c == nil {
+		return nil
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	s := *c.statsFor(repo)
+	return &s
+}
@@ -0,0 +1,174 @@
+package searcher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hound-search/hound/index"
+)
+
+func responseWithLine(line string) *index.SearchResponse {
+	return &index.SearchResponse{
+		Matches: []*index.FileMatch{{
+			Filename: "a.go",
+			Matches:  []*index.Match{{Line: line, LineNumber: 1}},
+		}},
+		FilesWithMatch: 1,
+	}
+}
+
+func mustKey(t *testing.T, repo, rev, pat string, opt *index.SearchOptions) cacheKey {
+	key, ok := keyFor(repo, rev, pat, opt)
+	if !ok {
+		t.Fatalf("expected %s to be cacheable", pat)
+	}
+	return key
+}
+
+func TestCacheKeys(t *testing.T) {
+	same := [][2]string{
+		{"a{1}b", "ab"},
+		{"(?:foo)", "foo"},
+	}
+	for _, pats := range same {
+		if mustKey(t, "r", "1", pats[0], &index.SearchOptions{}) != mustKey(t, "r", "1", pats[1], &index.SearchOptions{}) {
+			t.Errorf("expected %s and %s to share a key", pats[0], pats[1])
+		}
+	}
+
+	literal := mustKey(t, "r", "1", "a.b", &index.SearchOptions{LiteralSearch: true})
+	if literal != mustKey(t, "r", "1", `a\.b`, &index.SearchOptions{}) {
+		t.Error("expected a literal search to share a key with the escaped regexp")
+	}
+
+	base := mustKey(t, "r", "1", "foo", &index.SearchOptions{})
+	different := []cacheKey{
+		mustKey(t, "r", "2", "foo", &index.SearchOptions{}),
+		mustKey(t, "s", "1", "foo", &index.SearchOptions{}),
+		mustKey(t, "r", "1", "foo", &index.SearchOptions{IgnoreCase: true}),
+		mustKey(t, "r", "1", "foo", &index.SearchOptions{Limit: 10}),
+	}
+	for _, key := range different {
+		if key == base {
+			t.Errorf("expected %+v to have its own key", key)
+		}
+	}
+
+	if _, ok := keyFor("r", "1", "(", &index.SearchOptions{}); ok {
+		t.Error("expected an invalid pattern not to be cached")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	line := strings.Repeat("x", 100)
+	size := sizeOf(responseWithLine(line))
+	c := NewCache(2 * size)
+
+	opt := &index.SearchOptions{}
+	a := mustKey(t, "r", "1", "a", opt)
+	b := mustKey(t, "r", "1", "b", opt)
+	d := mustKey(t, "s", "1", "d", opt)
+
+	if _, ok := c.get(a); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+
+	c.add(a, responseWithLine(line))
+	c.add(b, responseWithLine(line))
+
+	// Use a, so b is the least recently used.
+	if _, ok := c.get(a); !ok {
+		t.Fatal("expected a hit")
+	}
+
+	c.add(d, responseWithLine(line))
+	if _, ok := c.get(b); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if _, ok := c.get(a); !ok {
+		t.Fatal("expected a to still be cached")
+	}
+
+	s := c.Stats("r")
+	if s.Hits != 2 || s.Misses != 2 || s.Entries != 1 || s.Bytes != size {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	c.removeRepo("r")
+	if _, ok := c.get(a); ok {
+		t.Fatal("expected the repo's results to be dropped")
+	}
+	if _, ok := c.get(d); !ok {
+		t.Fatal("expected other repos' results to be kept")
+	}
+
+	// Results bigger than the whole cache aren't kept.
+	c.add(a, responseWithLine(strings.Repeat("x", int(2*size))))
+	if _, ok := c.get(a); ok {
+		t.Fatal("expected a response bigger than the cache not to be kept")
+	}
+
+	if NewCache(0) != nil {
+		t.Fatal("expected no cache without a size")
+	}
+}
+
+func buildTestIndex(t *testing.T, rev, content string) *index.Index {
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "a.go"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := index.Build(&index.IndexOptions{}, filepath.Join(t.TempDir(), "idx"), src, "url", rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := ref.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+// A new index replaces the results cached for the old one, even when its
+// revision doesn't change.
+func TestCacheInvalidatedOnReindex(t *testing.T) {
+	s := &Searcher{
+		name:  "r",
+		idx:   buildTestIndex(t, "1", "old line\n"),
+		cache: NewCache(1 << 20),
+	}
+	defer s.Close()
+
+	opt := &index.SearchOptions{}
+	if _, err := s.Search("line", opt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Search("line", opt); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.cache.Stats("r"); st.Hits != 1 || st.Misses != 1 || st.Entries != 1 {
+		t.Fatalf("expected the second search to be cached, got %+v", st)
+	}
+
+	if err := s.swapIndexes(buildTestIndex(t, "1", "new line\n")); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.cache.Stats("r"); st.Entries != 0 || st.Bytes != 0 {
+		t.Fatalf("expected the cached results to be dropped, got %+v", st)
+	}
+
+	res, err := s.Search("line", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := s.cache.Stats("r"); st.Misses != 2 {
+		t.Fatalf("expected a miss after reindexing, got %+v", st)
+	}
+	if len(res.Matches) != 1 || res.Matches[0].Matches[0].Line != "new line" {
+		t.Fatalf("expected results from the new index, got %+v", res.Matches)
+	}
+}
@@ -22,6 +22,30 @@ type Searcher struct {
 	idx  *index.Index
 	lck  sync.RWMutex
 	Repo *config.Repo
+	name string
+
+	// Shared with the other searchers, nil if results aren't cached.
+	cache *Cache
+
+	// Called after the repo has been reindexed at a new revision.
+	reindexHooks []func()
+
+	// The working directory of the repo, used to blame matching lines.
+	// Blame holds wdLck for reading so that it doesn't run while the
+	// working directory is being updated.
+	wd     *vcs.WorkDir
+	vcsDir string
+	wdLck  sync.RWMutex
+	blames blameCache
+
+	// Why an existing index for the repo could not be reused on startup,
+	// this is empty unless an incompatible or corrupt index was replaced.
+	rebuildReason string
+
+	// When the repo was last brought up to date and why the most recent
+	// attempt to update it failed, if it did.
+	lastUpdated time.Time
+	lastError   string
 
 	// The channel is used to request updates from the API and
 	// to signal that it is ok for searchers to begin polling.
@@ -43,6 +67,16 @@ type searcherResult struct {
 	err      error
 }
 
+// The state of a searcher's index as reported to clients.
+type Status struct {
+	Rev           string
+	IndexedAt     time.Time
+	LastUpdated   time.Time
+	LastError     string      `json:",omitempty"`
+	RebuildReason string      `json:",omitempty"`
+	Cache         *CacheStats `json:",omitempty"`
+}
+
 type empty struct{}
 type limiter chan bool
 
@@ -54,6 +88,11 @@ type foundRefs struct {
 	refs    []*index.IndexRef
 	claimed map[*index.IndexRef]bool
 	lock    sync.Mutex
+
+	// Refs that can't be reused (because they are incompatible or corrupt)
+	// along with the reason. These are never claimed, so they are removed
+	// with the rest of the unclaimed refs.
+	rejected map[*index.IndexRef]error
 }
 
 func makeLimiter(n int) limiter {
@@ -74,6 +113,10 @@ func (l limiter) Release() {
  */
 func (r *foundRefs) find(url, rev string) *index.IndexRef {
 	for _, ref := range r.refs {
+		if r.rejected[ref] != nil {
+			continue
+		}
+
 		if ref.Url == url && ref.Rev == rev {
 			return ref
 		}
@@ -81,6 +124,19 @@ func (r *foundRefs) find(url, rev string) *index.IndexRef {
 	return nil
 }
 
+/**
+ * Find the reason an index for the repo url was rejected, returns nil if
+ * no index for the url was rejected.
+ */
+func (r *foundRefs) rejectedFor(url string) error {
+	for ref, err := range r.rejected {
+		if ref.Url == url {
+			return err
+		}
+	}
+	return nil
+}
+
 /**
  * Claim a ref for reuse. This ensures they ref will not be garbage
  * collected at the end of startup.
@@ -120,6 +176,7 @@ func (s *Searcher) swapIndexes(idx *index.Index) error {
 
 	oldIdx := s.idx
 	s.idx = idx
+	s.cache.removeRepo(s.name)
 
 	return oldIdx.Destroy()
 }
@@ -131,7 +188,96 @@ func (s *Searcher) swapIndexes(idx *index.Index) error {
 func (s *Searcher) Search(pat string, opt *index.SearchOptions) (*index.SearchResponse, error) {
 	s.lck.RLock()
 	defer s.lck.RUnlock()
-	return s.idx.Search(pat, opt)
+
+	key, ok := keyFor(s.name, s.idx.Ref.Rev, pat, opt)
+	if !ok || s.cache == nil {
+		return s.idx.Search(pat, opt)
+	}
+
+	if res, ok := s.cache.get(key); ok {
+		// Nothing was read to answer this search.
+		cp := *res
+		cp.FilesOpened = 0
+		cp.Duration = 0
+		return &cp, nil
+	}
+
+	res, err := s.idx.Search(pat, opt)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.add(key, res)
+	return res, nil
+}
+
+// Explain how a search on the current index narrows down the files it
+// reads.
+func (s *Searcher) Explain(pat string, opt *index.SearchOptions) (*index.Explanation, error) {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+	return s.idx.Explain(pat, opt)
+}
+
+// Does any file in the current index have the content with the given
+// hash? Only indexes in the shared content store can tell.
+func (s *Searcher) HasContent(contentHash string) bool {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+	return s.idx.HasContent(contentHash)
+}
+
+// OnReindex adds a function that is called each time the repo has been
+// reindexed at a new revision, once the new index is being searched.
+func (s *Searcher) OnReindex(fn func()) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.reindexHooks = append(s.reindexHooks, fn)
+}
+
+func (s *Searcher) reindexed() {
+	s.lck.RLock()
+	hooks := s.reindexHooks
+	s.lck.RUnlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// How many files and bytes of each language are in the current index.
+func (s *Searcher) Languages() map[string]*index.LanguageStats {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+	return s.idx.Ref.LanguageStats
+}
+
+// Get the status of the searcher's current index.
+func (s *Searcher) Status() *Status {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+	return &Status{
+		Rev:           s.idx.Ref.Rev,
+		IndexedAt:     s.idx.Ref.Time,
+		LastUpdated:   s.lastUpdated,
+		LastError:     s.lastError,
+		RebuildReason: s.rebuildReason,
+		Cache:         s.cache.Stats(s.name),
+	}
+}
+
+// Record the outcome of an attempt to update the repo. A nil error means
+// the repo is up to date.
+func (s *Searcher) updated(err error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+
+	s.lastUpdated = time.Now()
+	s.lastError = ""
 }
 
 // Get the excluded files as a JSON string. This is only used for returning
@@ -175,6 +321,14 @@ func (s *Searcher) Wait() {
 	<-s.doneCh
 }
 
+// Close the searcher's index. This should only be called once the searcher
+// has stopped and is no longer being searched.
+func (s *Searcher) Close() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.idx.Close()
+}
+
 func (s *Searcher) completeShutdown() {
 	close(s.doneCh)
 }
@@ -216,14 +370,25 @@ func findExistingRefs(dbpath string) (*foundRefs, error) {
 	}
 
 	var refs []*index.IndexRef
+	rejected := map[*index.IndexRef]error{}
 	for _, dir := range dirs {
-		r, _ := index.Read(dir)
+		r, err := index.Read(dir)
+		if err == nil {
+			err = r.Validate()
+		}
+
+		if err != nil {
+			log.Printf("Existing index %s can't be reused and will be removed: %s", dir, err)
+			rejected[r] = err
+		}
+
 		refs = append(refs, r)
 	}
 
 	return &foundRefs{
-		refs:    refs,
-		claimed: map[*index.IndexRef]bool{},
+		refs:     refs,
+		claimed:  map[*index.IndexRef]bool{},
+		rejected: rejected,
 	}, nil
 }
 
@@ -293,6 +458,11 @@ func MakeAll(cfg *config.Config) (map[string]*Searcher, map[string]error, error)
 
 	lim := makeLimiter(cfg.MaxConcurrentIndexers)
 
+	var cache *Cache
+	if cfg.Search != nil {
+		cache = NewCache(int64(cfg.Search.CacheSizeMB) * 1024 * 1024)
+	}
+
 	n := len(cfg.Repos)
 	// Channel to receive the results from newSearcherConcurrent function.
 	resultCh := make(chan searcherResult, n)
@@ -318,8 +488,15 @@ func MakeAll(cfg *config.Config) (map[string]*Searcher, map[string]error, error)
 		return nil, nil, err
 	}
 
+	// The indexes that are kept are all known now, so shared content that
+	// none of them use can be removed.
+	if err := index.SweepShared(cfg.DbPath); err != nil {
+		log.Printf("failed to clean up shared content in %s: %s", cfg.DbPath, err)
+	}
+
 	// after all the repos are in good shape, we start their polling
 	for _, s := range searchers {
+		s.cache = cache
 		s.begin()
 	}
 
@@ -339,6 +516,124 @@ func New(dbpath, name string, repo *config.Repo) (*Searcher, error) {
 	return s, nil
 }
 
+// Convert the submodules checked out in the vcs directory into the form that
+// is stored alongside an index.
+func submodulesFor(wd *vcs.WorkDir, vcsDir string) []*index.Submodule {
+	var subs []*index.Submodule
+	for _, sub := range wd.Submodules(vcsDir) {
+		subs = append(subs, &index.Submodule{
+			Path: sub.Path,
+			Url:  sub.Url,
+			Rev:  sub.Rev,
+		})
+	}
+	return subs
+}
+
+// Convert the recent history of the vcs directory into the form that is
+// stored alongside an index. Repos whose history can't be read are indexed
+// without it.
+func historyFor(wd *vcs.WorkDir, vcsDir string) []*index.Commit {
+	commits, err := wd.History(vcsDir)
+	if err != nil {
+		log.Printf("failed to read history of %s: %s", vcsDir, err)
+		return nil
+	}
+
+	var history []*index.Commit
+	for _, c := range commits {
+		files := make([]*index.FileDiff, 0, len(c.Files))
+		for _, f := range c.Files {
+			hunks := make([]*index.Hunk, 0, len(f.Hunks))
+			for _, h := range f.Hunks {
+				hunks = append(hunks, &index.Hunk{
+					Header: h.Header,
+					Lines:  h.Lines,
+				})
+			}
+			files = append(files, &index.FileDiff{
+				Path:  f.Path,
+				Hunks: hunks,
+			})
+		}
+
+		history = append(history, &index.Commit{
+			Hash:    c.Hash,
+			Author:  c.Author,
+			Date:    c.Date,
+			Message: c.Message,
+			Files:   files,
+		})
+	}
+	return history
+}
+
+// Determine the options used to index the working directory of the given
+// repo. Indexes built elsewhere (like with hound-index) must use the same
+// options to be interchangeable with the ones built by a Searcher.
+func IndexOptionsFor(repo *config.Repo, wd *vcs.WorkDir, vcsDir string) *index.IndexOptions {
+	var autoFiles []string
+	if len(repo.AutoGeneratedFiles) > 0 {
+		autoFiles = repo.AutoGeneratedFiles
+	} else {
+		autoFiles = wd.AutoGeneratedFiles(vcsDir)
+	}
+
+	return &index.IndexOptions{
+		ExcludeDotFiles:    repo.ExcludeDotFiles,
+		IndexArchives:      repo.IndexArchives,
+		SpecialFiles:       wd.SpecialFiles(),
+		AutoGeneratedFiles: autoFiles,
+		Submodules:         submodulesFor(wd, vcsDir),
+		ContentStore:       repo.ContentStore,
+		HistoryDepth:       wd.HistoryDepth(),
+	}
+}
+
+// A copy of opt with the recent history of the vcs directory, which is
+// only read when an index is about to be built.
+func withHistory(opt *index.IndexOptions, wd *vcs.WorkDir, vcsDir string) *index.IndexOptions {
+	cp := *opt
+	cp.History = historyFor(wd, vcsDir)
+	return &cp
+}
+
+// Pull or clone the given repo into its working directory under dbpath, just
+// as a Searcher would. Returns the working directory along with its path and
+// the revision that was checked out.
+func Checkout(dbpath string, repo *config.Repo) (*vcs.WorkDir, string, string, error) {
+	vcsDir := filepath.Join(dbpath, vcsDirFor(repo))
+
+	wd, err := vcs.New(repo.Vcs, repo.VcsConfig())
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	rev, err := wd.PullOrClone(vcsDir, repo.Url)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return wd, vcsDir, rev, nil
+}
+
+// Build a standalone index of the working directory vcsDir at the given rev.
+// The index is written to a new idx-* directory in dbpath where a Searcher
+// will claim it on startup as long as the repo url and revision match.
+func BuildIndex(
+	repo *config.Repo,
+	wd *vcs.WorkDir,
+	dbpath,
+	vcsDir,
+	rev string) (*index.IndexRef, error) {
+	return index.Build(
+		withHistory(IndexOptionsFor(repo, wd, vcsDir), wd, vcsDir),
+		nextIndexDir(dbpath),
+		vcsDir,
+		repo.Url,
+		rev)
+}
+
 // Update the vcs and reindex the given repo.
 func updateAndReindex(
 	s *Searcher,
@@ -355,20 +650,29 @@ func updateAndReindex(
 	defer lim.Release()
 
 	repo := s.Repo
+	s.wdLck.Lock()
 	newRev, err := wd.PullOrClone(vcsDir, repo.Url)
+	s.wdLck.Unlock()
 
 	if err != nil {
 		log.Printf("vcs pull error (%s - %s): %s", name, repo.Url, err)
+		s.updated(err)
 		return rev, false
 	}
 
 	if newRev == rev {
+		s.updated(nil)
 		return rev, false
 	}
 
 	log.Printf("Rebuilding %s for %s", name, newRev)
+
+	// submodules are pinned by the new revision, so their urls and
+	// revisions may have changed along with it.
+	opt.Submodules = submodulesFor(wd, vcsDir)
+
 	idx, err := buildAndOpenIndex(
-		opt,
+		withHistory(opt, wd, vcsDir),
 		dbpath,
 		vcsDir,
 		nextIndexDir(dbpath),
@@ -376,6 +680,7 @@ func updateAndReindex(
 		newRev)
 	if err != nil {
 		log.Printf("failed index build (%s): %s", name, err)
+		s.updated(err)
 		return rev, false
 	}
 
@@ -384,9 +689,11 @@ func updateAndReindex(
 		if err := idx.Destroy(); err != nil {
 			log.Printf("failed to destroy index (%s): %s\n", name, err)
 		}
+		s.updated(err)
 		return rev, false
 	}
 
+	s.updated(nil)
 	return newRev, true
 }
 
@@ -413,30 +720,34 @@ func newSearcher(
 		return nil, err
 	}
 
-	var autoFiles []string
-	if len(repo.AutoGeneratedFiles) > 0 {
-		autoFiles = repo.AutoGeneratedFiles
-	} else {
-		autoFiles = wd.AutoGeneratedFiles(vcsDir)
-	}
-
-	opt := &index.IndexOptions{
-		ExcludeDotFiles:    repo.ExcludeDotFiles,
-		SpecialFiles:       wd.SpecialFiles(),
-		AutoGeneratedFiles: autoFiles,
-	}
+	opt := IndexOptionsFor(repo, wd, vcsDir)
 
 	var idxDir string
+	var rebuildReason string
 	ref := refs.find(repo.Url, rev)
+	if ref != nil && ref.ContentStore != opt.ContentStore {
+		log.Printf("Rebuilding index for %s: content store changed", name)
+		ref = nil
+	} else if ref != nil && ref.HistoryDepth != opt.HistoryDepth {
+		log.Printf("Rebuilding index for %s: history changed", name)
+		ref = nil
+	}
+
+	buildOpt := opt
 	if ref == nil {
+		if err := refs.rejectedFor(repo.Url); err != nil {
+			rebuildReason = err.Error()
+			log.Printf("Rebuilding index for %s: %s", name, rebuildReason)
+		}
 		idxDir = nextIndexDir(dbpath)
+		buildOpt = withHistory(opt, wd, vcsDir)
 	} else {
 		idxDir = ref.Dir()
 		refs.claim(ref)
 	}
 
 	idx, err := buildAndOpenIndex(
-		opt,
+		buildOpt,
 		dbpath,
 		vcsDir,
 		idxDir,
@@ -447,11 +758,16 @@ func newSearcher(
 	}
 
 	s := &Searcher{
-		idx:        idx,
-		updateCh:   make(chan time.Time, 1),
-		Repo:       repo,
-		doneCh:     make(chan empty),
-		shutdownCh: make(chan empty, 1),
+		idx:           idx,
+		updateCh:      make(chan time.Time, 1),
+		Repo:          repo,
+		name:          name,
+		wd:            wd,
+		vcsDir:        vcsDir,
+		rebuildReason: rebuildReason,
+		lastUpdated:   time.Now(),
+		doneCh:        make(chan empty),
+		shutdownCh:    make(chan empty, 1),
 	}
 
 	go func() {
@@ -486,6 +802,7 @@ func newSearcher(
 			}
 
 			rev = newRev
+			s.reindexed()
 
 			// This is just a good time to GC since we know there will be a
 			// whole set of dead posting lists on the heap. Ensuring these
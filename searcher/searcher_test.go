@@ -0,0 +1,78 @@
+package searcher
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/vcs"
+)
+
+// A driver with a single revision that counts how often its history is
+// read.
+type historyDriver struct {
+	reads int
+	fail  bool
+}
+
+func (d *historyDriver) Clone(dir, url string) (string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return "r1", ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0600)
+}
+
+func (d *historyDriver) Pull(dir string) (string, error)    { return "r1", nil }
+func (d *historyDriver) HeadRev(dir string) (string, error) { return "r1", nil }
+func (d *historyDriver) SpecialFiles() []string             { return nil }
+func (d *historyDriver) AutoGeneratedFiles(string) []string { return nil }
+func (d *historyDriver) HistoryDepth() int                  { return 5 }
+
+func (d *historyDriver) History(dir string) ([]*vcs.Commit, error) {
+	d.reads++
+	if d.fail {
+		return nil, errors.New("git log failed")
+	}
+	return []*vcs.Commit{{Hash: "r1", Message: "first"}}, nil
+}
+
+// The history is only read to build an index, and an index built without
+// it because it couldn't be read is still claimed on the next startup.
+func TestHistoryOnlyReadForBuilds(t *testing.T) {
+	d := &historyDriver{fail: true}
+	vcs.Register(func(c []byte) (vcs.Driver, error) { return d, nil }, "test-history")
+
+	dbpath := t.TempDir()
+	repo := &config.Repo{Url: "https://example.com/r", Vcs: "test-history"}
+
+	s, err := newSearcher(dbpath, "r", repo, &foundRefs{}, makeLimiter(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := s.idx.GetDir()
+	s.Close()
+	if d.reads != 1 {
+		t.Fatalf("expected the history to be read for the build, read %d times", d.reads)
+	}
+
+	d.fail = false
+	refs, err := findExistingRefs(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = newSearcher(dbpath, "r", repo, refs, makeLimiter(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.idx.GetDir() != dir {
+		t.Fatalf("expected %s to be claimed, got %s", dir, s.idx.GetDir())
+	}
+	if d.reads != 1 {
+		t.Fatalf("expected the history not to be read for a claimed index, read %d times", d.reads)
+	}
+}
@@ -68,3 +68,13 @@ export function UrlToRepo(repo, path, line, rev) {
     // I'm sure there is a nicer React/jsx way to do this:
     return ExpandVars(pattern['base-url'], urlParts);
 }
+
+// Files inside of a submodule link to the submodule's own repository at the
+// commit that was indexed, using the url pattern of the superproject.
+export function UrlToSubmodule(repo, submodule, path, line) {
+    var info = {
+        url: submodule.Url,
+        'url-pattern': repo['url-pattern']
+    };
+    return UrlToRepo(info, path.substring(submodule.Path.length + 1), line, submodule.Rev);
+}
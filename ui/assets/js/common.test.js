@@ -1,4 +1,4 @@
-import { EscapeRegExp, ExpandVars, UrlToRepo, UrlParts } from "./common";
+import { EscapeRegExp, ExpandVars, UrlToRepo, UrlToSubmodule, UrlParts } from "./common";
 
 describe("EscapeRegExp", () => {
     const testRegs = [
@@ -181,3 +181,36 @@ describe("UrlToRepo", () => {
         );
     });
 });
+
+describe("UrlToSubmodule", () => {
+    const repo = {
+        url: "https://www.github.com/YourOrganization/RepoOne.git",
+        "url-pattern":
+        {
+            "base-url": "{url}/blob/{rev}/{path}{anchor}",
+            anchor: "#L{line}"
+        }
+    };
+
+    test("Generate url into the submodule's own repo", () => {
+        const submodule = {
+            Path: "third_party/lib",
+            Url: "https://www.github.com/Other/Lib.git",
+            Rev: "abc123"
+        };
+        expect(UrlToSubmodule(repo, submodule, "third_party/lib/src/a.c", 7)).toBe(
+            "https://www.github.com/Other/Lib/blob/abc123/src/a.c#L7"
+        );
+    });
+
+    test("Generate url for ssh style submodule urls", () => {
+        const submodule = {
+            Path: "lib",
+            Url: "git@github.com:Other/Lib.git",
+            Rev: "abc123"
+        };
+        expect(UrlToSubmodule(repo, submodule, "lib/README.md", null)).toBe(
+            "//github.com/Other/Lib/blob/abc123/README.md"
+        );
+    });
+});
@@ -1,4 +1,4 @@
-import { EscapeRegExp, UrlParts, UrlToRepo } from "./common";
+import { EscapeRegExp, UrlParts, UrlToRepo, UrlToSubmodule } from "./common";
 import { Signal } from "./signal";
 import reqwest from 'reqwest';
 import { merge } from 'merge-anything';
@@ -204,11 +204,19 @@ var Model = {
                     Server: stats.Duration,
                     Total: Date.now() - startedAt,
                     Files: stats.FilesOpened,
+                    PeerErrors: data.PeerErrors || {},
                 };
 
                 _this.didSearch.raise(_this, _this.results, _this.stats);
             },
             error: function (xhr, status, err) {
+                if (xhr.status == 429) {
+                    _this.didError.raise(
+                        this,
+                        "Hound is busy, try again in a few seconds"
+                    );
+                    return;
+                }
                 _this.didError.raise(this, "The server broke down");
             },
         });
@@ -275,8 +283,21 @@ var Model = {
         return url.substring(bx + 1, ax) + " / " + name;
     },
 
-    UrlToRepo: function (repo, path, line, rev) {
-        return UrlToRepo(this.repos[repo], path, line, rev);
+    UrlToRepo: function (repo, path, line, rev, submodule) {
+        var info = this.repos[repo];
+
+        // Members of an archive link to the archive itself.
+        var ax = path.indexOf("!/");
+        if (ax >= 0) {
+            path = path.substring(0, ax);
+            line = null;
+        }
+
+        if (submodule) {
+            return UrlToSubmodule(info, submodule, path, line);
+        }
+
+        return UrlToRepo(info, path, line, rev);
     },
 
     UrlToRoot: function (repo) {
@@ -478,6 +499,27 @@ var SearchBar = React.createClass({
         var stats = this.state.stats;
         var statsView = "";
         if (stats) {
+            // Results are partial when some of the peers failed to respond.
+            var peers = Object.keys(stats.PeerErrors),
+                peerErrorsView = "";
+            if (peers.length > 0) {
+                peerErrorsView = (
+                    <span>
+                        {" "}/{" "}
+                        <div
+                            className="val"
+                            title={peers
+                                .map(function (peer) {
+                                    return peer + ": " + stats.PeerErrors[peer];
+                                })
+                                .join("\n")}
+                        >
+                            partial results, {peers.length} servers unavailable
+                        </div>
+                    </span>
+                );
+            }
+
             statsView = (
                 <div className="stats">
                     <div className="stats-left">
@@ -494,6 +536,7 @@ var SearchBar = React.createClass({
                             {FormatNumber(stats.Server)}ms server
                         </div>{" "}
                         /<div className="val">{stats.Files} files</div>
+                        {peerErrorsView}
                     </div>
                 </div>
             );
@@ -742,6 +785,7 @@ var FileContentView = React.createClass({
             rev = this.props.rev,
             regexp = this.props.regexp,
             fileName = this.props.fileName,
+            submodule = this.props.submodule,
             blocks = this.props.blocks;
         var matches = blocks.map(function (block) {
             var lines = block.map(function (line) {
@@ -753,7 +797,8 @@ var FileContentView = React.createClass({
                                 repo,
                                 fileName,
                                 line.Number,
-                                rev
+                                rev,
+                                submodule
                             )}
                             className="lnum"
                             target="_blank"
@@ -778,17 +823,44 @@ var FileContentView = React.createClass({
             );
         }
 
+        // Generated files already have a badge of their own.
+        var classBadges = (this.props.classes || []).filter(function(name) {
+            return name != "generated";
+        }).map(function(name) {
+            return (
+                <span key={name} className="file-badge">{name.toUpperCase()}</span>
+            );
+        });
+
+        var duplicateBadge = null;
+        if (this.props.duplicateRepos > 0) {
+            duplicateBadge = (
+                <span className="file-badge">
+                    ALSO IN {this.props.duplicateRepos} OTHER{" "}
+                    {this.props.duplicateRepos == 1 ? "REPO" : "REPOS"}
+                </span>
+            );
+        }
+
         return (
             <div className={"file " + (this.state.open ? "open" : "closed")}>
                 <div className="title" onClick={this.toggleContent}>
                     <a
-                        href={Model.UrlToRepo(repo, fileName, null, rev)}
+                        href={Model.UrlToRepo(
+                            repo,
+                            fileName,
+                            null,
+                            rev,
+                            submodule
+                        )}
                         target="_blank"
                         rel="noopener noreferrer"
                     >
                         {fileName}
                     </a>
                     {autoGeneratedBadge}
+                    {classBadges}
+                    {duplicateBadge}
                 </div>
                 <div className="file-body">{matches}</div>
             </div>
@@ -818,6 +890,9 @@ var FilesView = React.createClass({
                     blocks={CoalesceMatches(match.Matches)}
                     regexp={regexp}
                     isAutoGenerated={match.AutoGenerated}
+                    duplicateRepos={match.DuplicateRepos}
+                    classes={match.Classes}
+                    submodule={match.Submodule}
                 />
             );
         });
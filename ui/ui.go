@@ -2,6 +2,7 @@ package ui
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	html_template "html/template"
@@ -10,8 +11,10 @@ import (
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"strings"
 	text_template "text/template"
 
+	"github.com/hound-search/hound/auth"
 	"github.com/hound-search/hound/config"
 )
 
@@ -28,6 +31,9 @@ type devHandler struct {
 
 	// the config we are running on
 	cfg *config.Config
+
+	// the repos that are shown in the UI
+	repos Repos
 }
 
 // An http.Handler for the prd-mode case.
@@ -35,15 +41,42 @@ type prdHandler struct {
 	// The collection of templated assets w/ their templates pre-parsed
 	content map[string]*content
 
-	// The config object as a json string
-	cfgJson string
-
 	// the config we are running on
 	cfg *config.Config
+
+	// the repos that are shown in the UI
+	repos Repos
+}
+
+// Repos produces the repos that are searchable from the UI by the caller of
+// the request. These are rendered into the pages each time they are served,
+// since they can change while the server runs.
+type Repos func(r *http.Request) map[string]*config.Repo
+
+// Encode the repos that are shown in the UI as a json string.
+func reposJson(repos Repos, r *http.Request) (string, error) {
+	b, err := json.Marshal(repos(r))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// The path of the request relative to the base path the UI is served
+// under. Returns false if the request is outside of the base path.
+func relativePath(cfg *config.Config, r *http.Request) (string, bool) {
+	if !strings.HasPrefix(r.URL.Path, cfg.BasePath+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(r.URL.Path, cfg.BasePath), true
 }
 
 func (h *devHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p := r.URL.Path
+	p, ok := relativePath(h.cfg, r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
 	// See if we have templated content for this path
 	cr := h.content[p]
@@ -55,14 +88,14 @@ func (h *devHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// If so, render the HTML
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	if err := renderForDev(w, h.root, cr, h.cfg, r); err != nil {
+	if err := renderForDev(w, h.root, cr, h.cfg, h.repos, r); err != nil {
 		log.Panic(err)
 	}
 }
 
 // Renders a templated asset in dev-mode. This simply embeds external script tags
 // for the source elements.
-func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, r *http.Request) error {
+func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, repos Repos, r *http.Request) error {
 	var err error
 	// For more context, see: https://github.com/etsy/hound/issues/239
 	switch c.tplType {
@@ -84,7 +117,7 @@ func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, r *h
 		return errors.New("invalid tplType for content")
 	}
 
-	json, err := cfg.ToJsonString()
+	json, err := reposJson(repos, r)
 	if err != nil {
 		return err
 	}
@@ -100,6 +133,7 @@ func renderForDev(w io.Writer, root string, c *content, cfg *config.Config, r *h
 		"Title":        cfg.Title,
 		"Source":       html_template.HTML(buf.String()),
 		"Host":         r.Host,
+		"BasePath":     cfg.BasePath,
 	})
 }
 
@@ -122,13 +156,17 @@ func serveAsset(w http.ResponseWriter, r *http.Request, name string) {
 }
 
 func (h *prdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p := r.URL.Path
+	p, ok := relativePath(h.cfg, r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
 	// see if we have a templated asset for this path
 	ct := h.content[p]
 	if ct != nil {
 		// if so, render it
-		if err := renderForPrd(w, ct, h.cfg, h.cfgJson, r); err != nil {
+		if err := renderForPrd(w, ct, h.cfg, h.repos, r); err != nil {
 			log.Panic(err)
 		}
 		return
@@ -142,7 +180,12 @@ func (h *prdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Renders a templated asset in prd-mode. This strategy will embed
 // the sources directly in a script tag on the templated page.
-func renderForPrd(w io.Writer, c *content, cfg *config.Config, cfgJson string, r *http.Request) error {
+func renderForPrd(w io.Writer, c *content, cfg *config.Config, repos Repos, r *http.Request) error {
+	json, err := reposJson(repos, r)
+	if err != nil {
+		return err
+	}
+
 	var buf bytes.Buffer
 	buf.WriteString("<script>")
 	for _, src := range c.sources {
@@ -156,10 +199,11 @@ func renderForPrd(w io.Writer, c *content, cfg *config.Config, cfgJson string, r
 
 	return c.tpl.Execute(w, map[string]interface{}{
 		"ReactVersion": ReactVersion,
-		"ReposAsJson":  cfgJson,
+		"ReposAsJson":  json,
 		"Title":        cfg.Title,
 		"Source":       html_template.HTML(buf.String()),
 		"Host":         r.Host,
+		"BasePath":     cfg.BasePath,
 	})
 }
 
@@ -176,18 +220,19 @@ func assetDir() string {
 }
 
 // Create an http.Handler for dev-mode.
-func newDevHandler(cfg *config.Config) (http.Handler, error) {
+func newDevHandler(cfg *config.Config, repos Repos) (http.Handler, error) {
 	root := assetDir()
 	return &devHandler{
-		Handler: http.FileServer(http.Dir(root)),
+		Handler: http.StripPrefix(cfg.BasePath, http.FileServer(http.Dir(root))),
 		content: contents,
 		root:    root,
 		cfg:     cfg,
+		repos:   repos,
 	}, nil
 }
 
 // Create an http.Handler for prd-mode.
-func newPrdHandler(cfg *config.Config) (http.Handler, error) {
+func newPrdHandler(cfg *config.Config, repos Repos) (http.Handler, error) {
 	for _, cnt := range contents {
 		a, err := Asset(cnt.template)
 		if err != nil {
@@ -215,15 +260,10 @@ func newPrdHandler(cfg *config.Config) (http.Handler, error) {
 		}
 	}
 
-	json, err := cfg.ToJsonString()
-	if err != nil {
-		return nil, err
-	}
-
 	return &prdHandler{
 		content: contents,
 		cfg:     cfg,
-		cfgJson: json,
+		repos:   repos,
 	}, nil
 }
 
@@ -231,11 +271,31 @@ func newPrdHandler(cfg *config.Config) (http.Handler, error) {
 // the http.Handler that is returned will serve assets directly our of
 // the source directories making rapid web development possible. If dev
 // is false, the http.Handler will serve assets out of data embedded
-// in the executable.
-func Content(dev bool, cfg *config.Config) (http.Handler, error) {
+// in the executable. If repos is nil, the repos in the config that the
+// caller is allowed to see are shown.
+func Content(dev bool, cfg *config.Config, repos Repos) (http.Handler, error) {
+	if repos == nil {
+		repos = func(r *http.Request) map[string]*config.Repo {
+			return ConfigRepos(cfg, r)
+		}
+	}
+
 	if dev {
-		return newDevHandler(cfg)
+		return newDevHandler(cfg, repos)
 	}
 
-	return newPrdHandler(cfg)
+	return newPrdHandler(cfg, repos)
+}
+
+// ConfigRepos returns the repos in the config that the caller of the request
+// is allowed to see, as they are shown to the caller.
+func ConfigRepos(cfg *config.Config, r *http.Request) map[string]*config.Repo {
+	id := auth.IdentityFrom(r)
+	res := map[string]*config.Repo{}
+	for name, repo := range cfg.Repos {
+		if id.CanAccess(repo) {
+			res[name] = repo.Public()
+		}
+	}
+	return res
 }
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const defaultRef = "master"
@@ -22,9 +25,11 @@ func init() {
 }
 
 type GitDriver struct {
-	DetectRef     bool   `json:"detect-ref"`
-	Ref           string `json:"ref"`
-	refDetetector refDetetector
+	DetectRef      bool   `json:"detect-ref"`
+	Ref            string `json:"ref"`
+	WithSubmodules bool   `json:"submodules"`
+	HistoryCommits int    `json:"history-commits"`
+	refDetetector  refDetetector
 }
 
 type refDetetector interface {
@@ -88,6 +93,17 @@ func run(desc, dir, cmd string, args ...string) (string, error) {
 	return string(out), nil
 }
 
+// Like run, but failures are returned rather than logged and ignored.
+func runChecked(desc, dir, cmd string, args ...string) error {
+	c := exec.Command(cmd, args...)
+	c.Dir = dir
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to %s in %s: %s\n%s", desc, dir, err, out)
+	}
+	return nil
+}
+
 func (g *GitDriver) Pull(dir string) (string, error) {
 	targetRef := g.targetRef(dir)
 
@@ -96,7 +112,7 @@ func (g *GitDriver) Pull(dir string) (string, error) {
 		"fetch",
 		"--prune",
 		"--no-tags",
-		"--depth", "1",
+		"--depth", g.fetchDepth(),
 		"origin",
 		fmt.Sprintf("+%s:remotes/origin/%s", targetRef, targetRef)); err != nil {
 		return "", err
@@ -110,9 +126,67 @@ func (g *GitDriver) Pull(dir string) (string, error) {
 		return "", err
 	}
 
+	if g.WithSubmodules {
+		if err := g.updateSubmodules(dir); err != nil {
+			return "", err
+		}
+	}
+
 	return g.HeadRev(dir)
 }
 
+// Only the head commit is fetched, unless the history is wanted. The
+// parent of the oldest commit in the history is needed to diff it.
+func (g *GitDriver) fetchDepth() string {
+	if g.HistoryCommits > 0 {
+		return strconv.Itoa(g.HistoryCommits + 1)
+	}
+	return "1"
+}
+
+// Initialize and update all submodules (recursively) with the same shallow
+// depth as the superproject. Syncing first ensures that changes to the
+// urls in .gitmodules are picked up. Submodules that are pinned to a commit
+// a shallow fetch can't reach, like one that isn't the tip of a branch,
+// are fetched in full instead.
+func (g *GitDriver) updateSubmodules(dir string) error {
+	if err := runChecked("git submodule sync", dir,
+		"git",
+		"submodule",
+		"sync",
+		"--recursive"); err != nil {
+		return err
+	}
+
+	err := runChecked("git submodule update", dir,
+		"git",
+		"submodule",
+		"update",
+		"--init",
+		"--recursive",
+		"--depth", "1")
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("Shallow submodule update failed, fetching them in full: %s", err)
+	if err := runChecked("git submodule foreach", dir,
+		"git",
+		"submodule",
+		"foreach",
+		"--recursive",
+		"git fetch --unshallow || git fetch"); err != nil {
+		return err
+	}
+
+	return runChecked("git submodule update", dir,
+		"git",
+		"submodule",
+		"update",
+		"--init",
+		"--recursive")
+}
+
 func (g *GitDriver) targetRef(dir string) string {
 	var targetRef string
 	if g.Ref != "" {
@@ -197,6 +271,256 @@ func (g *GitDriver) AutoGeneratedFiles(dir string) []string {
 	return files
 }
 
+// Each commit starts with a NUL and its fields are separated by NULs, so
+// that they can't be confused with the patch that follows them.
+const historyFormat = "%x00%H%x00%an <%ae>%x00%aI%x00%B%x00"
+
+func (g *GitDriver) HistoryDepth() int {
+	if g.HistoryCommits <= 0 {
+		return 0
+	}
+	return g.HistoryCommits
+}
+
+func (g *GitDriver) History(dir string) ([]*Commit, error) {
+	if g.HistoryCommits <= 0 {
+		return nil, nil
+	}
+
+	cmd := exec.Command(
+		"git",
+		"-c", "core.quotePath=false",
+		"log",
+		"-n", strconv.Itoa(g.HistoryCommits),
+		"-p",
+		"-U0",
+		"--no-color",
+		"--no-ext-diff",
+		"--format="+historyFormat,
+		"HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log in %s: %s", dir, err)
+	}
+
+	return parseGitLog(out), nil
+}
+
+func parseGitLog(out []byte) []*Commit {
+	fields := strings.Split(string(out), "\x00")
+
+	var commits []*Commit
+	for i := 1; i+4 < len(fields); i += 5 {
+		date, err := time.Parse(time.RFC3339, fields[i+2])
+		if err != nil {
+			log.Printf("Unexpected date %q for commit %s: %s", fields[i+2], fields[i], err)
+		}
+
+		commits = append(commits, &Commit{
+			Hash:    fields[i],
+			Author:  fields[i+1],
+			Date:    date,
+			Message: strings.TrimSpace(fields[i+3]),
+			Files:   parsePatch(fields[i+4]),
+		})
+	}
+	return commits
+}
+
+// Read the hunks of each file out of a patch without context lines. Files
+// that have no hunks, like binary files, are left out.
+func parsePatch(patch string) []*FileDiff {
+	var files []*FileDiff
+	var file *FileDiff
+	var hunk *Hunk
+	for _, line := range strings.Split(patch, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			file = &FileDiff{}
+			hunk = nil
+		case file == nil:
+			continue
+		case strings.HasPrefix(line, "@@"):
+			hunk = &Hunk{Header: line}
+			file.Hunks = append(file.Hunks, hunk)
+			if len(file.Hunks) == 1 {
+				files = append(files, file)
+			}
+		case hunk == nil && strings.HasPrefix(line, "--- a/"):
+			file.Path = line[len("--- a/"):]
+		case hunk == nil && strings.HasPrefix(line, "+++ b/"):
+			file.Path = line[len("+++ b/"):]
+		case hunk != nil && (strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")):
+			hunk.Lines = append(hunk.Lines, line)
+		}
+	}
+	return files
+}
+
+// The commits that a shallow clone was cut off at, which git treats as if
+// they had no parents.
+func shallowCommits(dir string) map[string]bool {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--git-path", "shallow").Output()
+	if err != nil {
+		return nil
+	}
+
+	name := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+
+	commits := map[string]bool{}
+	for _, c := range strings.Fields(string(b)) {
+		commits[c] = true
+	}
+	return commits
+}
+
+// Hound's clones are shallow, so git attributes lines that were last
+// changed before the oldest commit that was fetched to that commit. Those
+// lines are left nil.
+func (g *GitDriver) Blame(dir, rev, path string) ([]*BlameLine, error) {
+	cmd := exec.Command(
+		"git",
+		"blame",
+		"--root",
+		"--porcelain",
+		rev,
+		"--",
+		path)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git blame %s in %s: %s", path, dir, err)
+	}
+
+	return parseBlame(out, shallowCommits(dir)), nil
+}
+
+// The porcelain format has a header line of <commit> <original line>
+// <final line> [<lines in group>] for every line, followed by details
+// of the commit the first time it appears, then the line itself after a
+// tab.
+func parseBlame(out []byte, shallow map[string]bool) []*BlameLine {
+	type commitInfo struct {
+		line     BlameLine
+		email    string
+		boundary bool
+	}
+
+	var lines []*BlameLine
+	commits := map[string]*commitInfo{}
+	var cur *commitInfo
+	var lineno int
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "\t") {
+			if cur == nil || lineno < 1 {
+				continue
+			}
+
+			for len(lines) < lineno {
+				lines = append(lines, nil)
+			}
+
+			if !cur.boundary {
+				b := cur.line
+				if cur.email != "" {
+					b.Author += " " + cur.email
+				}
+				lines[lineno-1] = &b
+			}
+			continue
+		}
+
+		key, val := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			key, val = line[:i], line[i+1:]
+		}
+
+		if fields := strings.Fields(line); len(fields) >= 3 && len(key) >= 40 {
+			if n, err := strconv.Atoi(fields[2]); err == nil {
+				cur = commits[key]
+				if cur == nil {
+					cur = &commitInfo{
+						line:     BlameLine{Commit: key},
+						boundary: shallow[key],
+					}
+					commits[key] = cur
+				}
+				lineno = n
+				continue
+			}
+		}
+
+		if cur == nil {
+			continue
+		}
+
+		switch key {
+		case "author":
+			cur.line.Author = val
+		case "author-mail":
+			cur.email = val
+		case "author-time":
+			if t, err := strconv.ParseInt(val, 10, 64); err == nil {
+				cur.line.Date = time.Unix(t, 0).UTC()
+			}
+		case "boundary":
+			cur.boundary = true
+		}
+	}
+	return lines
+}
+
+// Each submodule is reported on its own line as <path> TAB <sha1> TAB <url>.
+const submoduleForeachCmd = `printf '%s\t%s\t%s\n' "$displaypath" "$sha1" "$(git config --get remote.origin.url)"`
+
+func (g *GitDriver) Submodules(dir string) []*Submodule {
+	if !g.WithSubmodules {
+		return nil
+	}
+
+	cmd := exec.Command(
+		"git",
+		"submodule",
+		"foreach",
+		"--quiet",
+		"--recursive",
+		submoduleForeachCmd)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("Error occured when running git submodule foreach in %s: %s.", dir, err)
+		return nil
+	}
+
+	return parseSubmodules(out)
+}
+
+func parseSubmodules(out []byte) []*Submodule {
+	var subs []*Submodule
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(parts) != 3 || parts[0] == "" {
+			continue
+		}
+
+		subs = append(subs, &Submodule{
+			Path: filepath.ToSlash(parts[0]),
+			Rev:  parts[1],
+			Url:  parts[2],
+		})
+	}
+	return subs
+}
+
 func (d *headBranchDetector) detectRef(dir string) string {
 	output, err := run("git show remote info", dir,
 		"git",
@@ -2,7 +2,15 @@ package vcs
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testRefDetector struct {
@@ -83,3 +91,241 @@ func TestTargetRef(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSubmodules(t *testing.T) {
+	out := []byte("lib/foo\tabc123\thttps://example.com/foo.git\n" +
+		"lib/foo/nested\tdef456\tgit@example.com:org/nested.git\n" +
+		"\n" +
+		"malformed line\n")
+
+	subs := parseSubmodules(out)
+	if len(subs) != 2 {
+		t.Fatalf("expected 2 submodules, got %d", len(subs))
+	}
+
+	if subs[0].Path != "lib/foo" || subs[0].Rev != "abc123" || subs[0].Url != "https://example.com/foo.git" {
+		t.Errorf("unexpected submodule: %+v", subs[0])
+	}
+
+	if subs[1].Path != "lib/foo/nested" || subs[1].Rev != "def456" || subs[1].Url != "git@example.com:org/nested.git" {
+		t.Errorf("unexpected submodule: %+v", subs[1])
+	}
+}
+
+// Failures of the submodule commands must not be hidden, or a repo would
+// be indexed without its submodules.
+func TestUpdateSubmodulesError(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hound-vcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := &GitDriver{WithSubmodules: true}
+	if err := g.updateSubmodules(dir); err == nil {
+		t.Fatal("expected an error updating submodules outside of a repo")
+	}
+}
+
+func TestParseGitLog(t *testing.T) {
+	out := []byte("\x00abc123\x00Ann <ann@example.com>\x002021-03-04T05:06:07+01:00\x00Remove the old client\n\nIt was unused.\n\x00\n" +
+		"diff --git a/client.go b/client.go\n" +
+		"deleted file mode 100644\n" +
+		"index 1111111..0000000\n" +
+		"--- a/client.go\n" +
+		"+++ /dev/null\n" +
+		"@@ -1,2 +0,0 @@\n" +
+		"-package client\n" +
+		"--- a/decrement\n" +
+		"diff --git a/logo.png b/logo.png\n" +
+		"Binary files a/logo.png and b/logo.png differ\n" +
+		"diff --git a/main.go b/main.go\n" +
+		"--- a/main.go\n" +
+		"+++ b/main.go\n" +
+		"@@ -3 +3 @@ import (\n" +
+		"-\t\"client\"\n" +
+		"+\t\"server\"\n" +
+		"@@ -10,0 +11 @@ func main() {\n" +
+		"+\tserver.Run()\n" +
+		"\x00def456\x00Bob <bob@example.com>\x002021-03-01T00:00:00Z\x00Merge branch 'x'\n\x00")
+
+	commits := parseGitLog(out)
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits, got %d", len(commits))
+	}
+
+	c := commits[0]
+	if c.Hash != "abc123" || c.Author != "Ann <ann@example.com>" || c.Message != "Remove the old client\n\nIt was unused." {
+		t.Errorf("unexpected commit: %+v", c)
+	}
+	if c.Date.UTC() != time.Date(2021, 3, 4, 4, 6, 7, 0, time.UTC) {
+		t.Errorf("unexpected date: %s", c.Date)
+	}
+
+	if len(c.Files) != 2 {
+		t.Fatalf("expected the binary file to be left out, got %d files", len(c.Files))
+	}
+	if c.Files[0].Path != "client.go" || !reflect.DeepEqual(c.Files[0].Hunks[0].Lines, []string{"-package client", "--- a/decrement"}) {
+		t.Errorf("unexpected diff: %+v", c.Files[0].Hunks[0])
+	}
+	if c.Files[1].Path != "main.go" || len(c.Files[1].Hunks) != 2 || c.Files[1].Hunks[1].Header != "@@ -10,0 +11 @@ func main() {" {
+		t.Errorf("unexpected diff: %+v", c.Files[1])
+	}
+
+	if commits[1].Hash != "def456" || len(commits[1].Files) != 0 {
+		t.Errorf("unexpected merge commit: %+v", commits[1])
+	}
+}
+
+func TestParseBlame(t *testing.T) {
+	const (
+		c1 = "0fe92b17deda569a6825649a5985a19b24cb6b8e"
+		c2 = "249c3eb69d849ba2941d6055010e98e361449b1a"
+	)
+
+	out := []byte(c1 + " 1 1 1\n" +
+		"author Ann A\n" +
+		"author-mail <ann@example.com>\n" +
+		"author-time 1614556800\n" +
+		"author-tz +0000\n" +
+		"summary c1\n" +
+		"filename f.txt\n" +
+		"\tone\n" +
+		c2 + " 2 2 2\n" +
+		"author Bob B\n" +
+		"author-mail <bob@example.com>\n" +
+		"author-time 1614643200\n" +
+		"summary c2\n" +
+		"previous " + c1 + " f.txt\n" +
+		"filename f.txt\n" +
+		"\tTWO\n" +
+		c2 + " 3 3\n" +
+		"\tthree\n")
+
+	lines := parseBlame(out, nil)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+
+	if lines[0].Commit != c1 || lines[0].Author != "Ann A <ann@example.com>" || !lines[0].Date.Equal(time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected blame for line 1: %+v", lines[0])
+	}
+
+	if *lines[1] != *lines[2] || lines[2].Commit != c2 || lines[2].Author != "Bob B <bob@example.com>" {
+		t.Errorf("unexpected blame for line 3: %+v", lines[2])
+	}
+
+	// Lines from the commit a shallow clone was cut off at are unknown.
+	lines = parseBlame(out, map[string]bool{c1: true})
+	if lines[0] != nil || lines[1] == nil {
+		t.Errorf("expected only the first line to be unknown, got %v", lines)
+	}
+}
+
+// Run git in dir for a test, with an identity to commit as.
+func gitForTest(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=Ann", "-c", "user.email=ann@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %s\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Make a repo in dir with a commit for each of the contents of f.
+func makeRepo(t *testing.T, dir string, contents ...string) {
+	gitForTest(t, dir, "init", "-q")
+	for _, c := range contents {
+		if err := ioutil.WriteFile(filepath.Join(dir, "f"), []byte(c), 0600); err != nil {
+			t.Fatal(err)
+		}
+		gitForTest(t, dir, "add", "f")
+		gitForTest(t, dir, "commit", "-q", "-m", c)
+	}
+}
+
+// Set the git config for the commands a test runs through the environment,
+// undoing it when the test is done.
+func setGitConfig(t *testing.T, kv ...string) {
+	env := []string{"GIT_CONFIG_COUNT", strconv.Itoa(len(kv) / 2)}
+	for i := 0; i < len(kv); i += 2 {
+		n := strconv.Itoa(i / 2)
+		env = append(env, "GIT_CONFIG_KEY_"+n, kv[i], "GIT_CONFIG_VALUE_"+n, kv[i+1])
+	}
+
+	for i := 0; i < len(env); i += 2 {
+		name := env[i]
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, env[i+1])
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+// A failing fetch leaves the working directory at the revision it has.
+func TestPullContinuesAfterFetchFailure(t *testing.T) {
+	root := t.TempDir()
+	origin := filepath.Join(root, "origin")
+	if err := os.Mkdir(origin, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	makeRepo(t, origin, "one")
+	rev := gitForTest(t, origin, "rev-parse", "HEAD")
+	branch := gitForTest(t, origin, "rev-parse", "--abbrev-ref", "HEAD")
+
+	g := &GitDriver{Ref: branch}
+	dir := filepath.Join(root, "clone")
+	if got, err := g.Clone(dir, origin); err != nil || got != rev {
+		t.Fatalf("expected to clone %s, got %s %v", rev, got, err)
+	}
+
+	if err := os.RemoveAll(origin); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.Pull(dir); err != nil || got != rev {
+		t.Fatalf("expected to stay at %s, got %s %v", rev, got, err)
+	}
+}
+
+// A submodule pinned to a commit that a shallow fetch can't get, since it
+// isn't the tip of a branch, is fetched in full.
+func TestSubmodulePinnedToOldCommit(t *testing.T) {
+	// The original protocol only serves commits that refs point to.
+	setGitConfig(t, "protocol.file.allow", "always", "protocol.version", "0")
+
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	super := filepath.Join(root, "super")
+	for _, d := range []string{sub, super} {
+		if err := os.Mkdir(d, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	makeRepo(t, sub, "one")
+	pinned := gitForTest(t, sub, "rev-parse", "HEAD")
+	makeRepo(t, sub, "two")
+
+	makeRepo(t, super, "one")
+	gitForTest(t, super, "submodule", "add", "-q", "file://"+filepath.ToSlash(sub), "lib")
+	gitForTest(t, filepath.Join(super, "lib"), "checkout", "-q", pinned)
+	gitForTest(t, super, "add", "lib")
+	gitForTest(t, super, "commit", "-q", "-m", "pin lib")
+	branch := gitForTest(t, super, "rev-parse", "--abbrev-ref", "HEAD")
+
+	g := &GitDriver{Ref: branch, WithSubmodules: true}
+	dir := filepath.Join(root, "clone")
+	if _, err := g.Clone(dir, "file://"+filepath.ToSlash(super)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := gitForTest(t, filepath.Join(dir, "lib"), "rev-parse", "HEAD"); got != pinned {
+		t.Fatalf("expected the submodule at %s, got %s", pinned, got)
+	}
+}
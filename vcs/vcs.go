@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 // A collection that maps vcs names to their underlying
@@ -32,6 +33,76 @@ type Driver interface {
 
 }
 
+// A nested repository that is checked out inside of a working directory
+// (like a git submodule). Path is relative to the root of the working
+// directory.
+type Submodule struct {
+	Path string
+	Url  string
+	Rev  string
+}
+
+// An optional interface for drivers that are able to check out nested
+// repositories. Drivers that do not implement it have no submodules.
+type SubmoduleLister interface {
+
+	// Return the submodules that are checked out in the working directory.
+	Submodules(dir string) []*Submodule
+}
+
+// A commit along with the lines that it added and removed.
+type Commit struct {
+	Hash    string
+	Author  string
+	Date    time.Time
+	Message string
+	Files   []*FileDiff
+}
+
+// The hunks of a commit that changed the file at Path.
+type FileDiff struct {
+	Path  string
+	Hunks []*Hunk
+}
+
+// The added and removed lines of a hunk, each starting with a + or a -.
+// Header is the hunk's @@ line.
+type Hunk struct {
+	Header string
+	Lines  []string
+}
+
+// An optional interface for drivers that are able to read the recent
+// history of a working directory. Drivers that do not implement it have
+// no history.
+type HistoryReader interface {
+
+	// Return the most recent commits, newest first, or nil if the history
+	// isn't wanted.
+	History(dir string) ([]*Commit, error)
+
+	// How many commits History returns at most, 0 if the history isn't
+	// wanted.
+	HistoryDepth() int
+}
+
+// Who last changed a line of a file, and when.
+type BlameLine struct {
+	Author string
+	Commit string
+	Date   time.Time
+}
+
+// An optional interface for drivers that can tell who last changed each
+// line of a file. Drivers that do not implement it have no blame.
+type Blamer interface {
+
+	// Return who last changed each line of the file at path (relative to
+	// the working directory) as of rev, starting with the first line.
+	// Lines that can't be attributed to a commit are nil.
+	Blame(dir, rev, path string) ([]*BlameLine, error)
+}
+
 // An API to interact with a vcs working directory. This is
 // what clients will interact with.
 type WorkDir struct {
@@ -71,6 +142,42 @@ func exists(path string) bool {
 	return true
 }
 
+// Return the submodules checked out in the working directory, or nil if
+// the underlying driver does not support them.
+func (w *WorkDir) Submodules(dir string) []*Submodule {
+	if l, ok := w.Driver.(SubmoduleLister); ok {
+		return l.Submodules(dir)
+	}
+	return nil
+}
+
+// Return the recent history of the working directory, or nil if the
+// underlying driver does not support it.
+func (w *WorkDir) History(dir string) ([]*Commit, error) {
+	if h, ok := w.Driver.(HistoryReader); ok {
+		return h.History(dir)
+	}
+	return nil, nil
+}
+
+// Return how many commits of history are wanted, or 0 if the underlying
+// driver does not support it.
+func (w *WorkDir) HistoryDepth() int {
+	if h, ok := w.Driver.(HistoryReader); ok {
+		return h.HistoryDepth()
+	}
+	return 0
+}
+
+// Return who last changed each line of a file, or nil if the underlying
+// driver does not support blame.
+func (w *WorkDir) Blame(dir, rev, path string) ([]*BlameLine, error) {
+	if b, ok := w.Driver.(Blamer); ok {
+		return b.Blame(dir, rev, path)
+	}
+	return nil, nil
+}
+
 // A utility method that carries out the common operation of cloning
 // if the working directory is absent and pulling otherwise.
 func (w *WorkDir) PullOrClone(dir, url string) (string, error) {
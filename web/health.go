@@ -0,0 +1,120 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hound-search/hound/auth"
+	"github.com/hound-search/hound/searcher"
+)
+
+// The body of the readiness check. It counts the repos that failed to index
+// or update, or have gone stale. The check is served without authentication,
+// so the unhealthy repos are only listed, with what is wrong with them, for
+// callers who would be allowed to see them through the API.
+type readiness struct {
+	Ready          bool
+	Reason         string `json:",omitempty"`
+	Repos          int
+	Unhealthy      int
+	UnhealthyRepos map[string]string `json:",omitempty"`
+}
+
+// Find the repos that either failed to index on startup, failed their most
+// recent update or haven't been updated within staleAfter. Repos that are not
+// polled can't go stale.
+func unhealthyRepos(
+	idx map[string]*searcher.Searcher,
+	failed map[string]error,
+	staleAfter time.Duration,
+	now time.Time) map[string]string {
+	res := map[string]string{}
+	for name, err := range failed {
+		res[name] = fmt.Sprintf("failed to index: %s", err)
+	}
+
+	for name, srch := range idx {
+		st := srch.Status()
+		switch {
+		case st.LastError != "":
+			res[name] = fmt.Sprintf("failed to update: %s", st.LastError)
+		case staleAfter > 0 && srch.Repo.PollUpdatesEnabled() && now.Sub(st.LastUpdated) > staleAfter:
+			res[name] = fmt.Sprintf("not updated since %s", st.LastUpdated.Format(time.RFC3339))
+		}
+	}
+	return res
+}
+
+// The identity of the caller of the readiness check and whether the API
+// would serve them. Everyone is served when there is no authentication.
+func (s *Server) readinessCaller(r *http.Request) (*auth.Identity, bool) {
+	if s.auth == nil {
+		return nil, true
+	}
+
+	id, err := s.auth.Authenticate(r)
+	if err != nil {
+		return nil, false
+	}
+	return id, true
+}
+
+func (s *Server) readiness(r *http.Request) *readiness {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+
+	if s.mux == nil {
+		return &readiness{Reason: "indexes are still being built"}
+	}
+
+	var staleAfter time.Duration
+	if s.cfg.Readiness != nil {
+		staleAfter = time.Duration(s.cfg.Readiness.StaleAfterMs) * time.Millisecond
+	}
+
+	unhealthy := unhealthyRepos(s.idx, s.failed, staleAfter, time.Now())
+	res := &readiness{
+		Ready:     true,
+		Repos:     len(s.idx) + len(s.failed),
+		Unhealthy: len(unhealthy),
+	}
+
+	if id, ok := s.readinessCaller(r); ok {
+		for name, reason := range unhealthy {
+			repo := s.cfg.Repos[name]
+			if srch := s.idx[name]; srch != nil {
+				repo = srch.Repo
+			}
+
+			if repo != nil && id.CanAccess(repo) {
+				if res.UnhealthyRepos == nil {
+					res.UnhealthyRepos = map[string]string{}
+				}
+				res.UnhealthyRepos[name] = reason
+			}
+		}
+	}
+
+	if s.cfg.Readiness != nil && res.Unhealthy > *s.cfg.Readiness.MaxUnhealthyRepos {
+		res.Ready = false
+		res.Reason = fmt.Sprintf("%d repos are unhealthy, at most %d are allowed",
+			res.Unhealthy, *s.cfg.Readiness.MaxUnhealthyRepos)
+	}
+
+	return res
+}
+
+func (s *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	res := s.readiness(r)
+
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res) //nolint
+}
@@ -0,0 +1,158 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+// How often the certificate and key are checked for changes on disk.
+const certCheckInterval = 30 * time.Second
+
+// Serves the most recently loaded certificate so that it can be replaced
+// without restarting. Connections that are already open keep the
+// certificate they were established with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lck     sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// The time that the newer of the certificate and key was modified.
+func (c *certReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// Load the certificate and key from disk. If they can't be loaded, the
+// current certificate continues to be served.
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// Reload the certificate if either file has changed since it was loaded.
+// Returns true if a new certificate was loaded.
+func (c *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return false, err
+	}
+
+	c.lck.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.lck.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	if err := c.reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *certReloader) watch() {
+	for range time.Tick(certCheckInterval) {
+		changed, err := c.reloadIfChanged()
+		if err != nil {
+			log.Printf("failed to reload tls certificate: %s", err)
+		} else if changed {
+			log.Printf("reloaded tls certificate from %s", c.certFile)
+		}
+	}
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lck.RLock()
+	defer c.lck.RUnlock()
+	return c.cert, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// Create the tls.Config for serving HTTPS. Client certificates are verified
+// when they are given, ServeHTTP decides which requests require them.
+func newTLSConfig(cfg *config.TLSConfig) (*tls.Config, *certReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, nil, errors.New("tls requires both a cert-file and a key-file")
+	}
+
+	certs, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return c, certs, nil
+}
@@ -0,0 +1,217 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Create a certificate for name signed by parent, or self-signed if parent
+// is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tpl, key
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+		tpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// Write the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func serial(t *testing.T, c *certReloader) int64 {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.SerialNumber.Int64()
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", nil)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := c.reloadIfChanged(); err != nil || changed {
+		t.Fatalf("expected no change, got %v %v", changed, err)
+	}
+
+	second := newTestCert(t, "second", nil)
+	second.write(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if changed, err := c.reloadIfChanged(); err != nil || !changed {
+		t.Fatalf("expected a change, got %v %v", changed, err)
+	}
+	if serial(t, c) != second.cert.SerialNumber.Int64() {
+		t.Fatal("expected the new certificate to be served")
+	}
+
+	// A broken certificate doesn't replace the one being served.
+	if err := os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.reload(); err == nil {
+		t.Fatal("expected an error loading a broken certificate")
+	}
+	if serial(t, c) != second.cert.SerialNumber.Int64() {
+		t.Fatal("expected the previous certificate to still be served")
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServeTLSWithClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	client := newTestCert(t, "client", ca)
+
+	cfg := &config.Config{
+		HealthCheckURI: "/healthz",
+		TLS: &config.TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: caFile,
+		},
+	}
+
+	addr := freeAddr(t)
+	s, err := Start(cfg, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background()) //nolint
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	get := func(path string, certs ...tls.Certificate) *http.Response {
+		c := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+				ForceAttemptHTTP2: true,
+			},
+		}
+
+		var lastErr error
+		for i := 0; i < 50; i++ {
+			res, err := c.Get("https://" + addr + path)
+			if err == nil {
+				res.Body.Close()
+				return res
+			}
+			lastErr = err
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal(lastErr)
+		return nil
+	}
+
+	res := get("/healthz")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the health check to pass, got %d", res.StatusCode)
+	}
+	if res.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", res.Proto)
+	}
+
+	if res := get("/api/v1/repos"); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the API to require a client certificate, got %d", res.StatusCode)
+	}
+
+	// Not ready yet, but past the client certificate check.
+	if res := get("/api/v1/repos", client.tlsCertificate()); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the API to accept the client certificate, got %d", res.StatusCode)
+	}
+}
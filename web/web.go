@@ -1,12 +1,18 @@
 package web
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/hound-search/hound/api"
+	"github.com/hound-search/hound/audit"
+	"github.com/hound-search/hound/auth"
 	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/federation"
+	"github.com/hound-search/hound/saved"
 	"github.com/hound-search/hound/searcher"
 	"github.com/hound-search/hound/ui"
 )
@@ -20,16 +26,71 @@ type Server struct {
 	dev bool
 	ch  chan error
 
+	// nil when authentication is not configured.
+	auth *auth.Chain
+
+	// nil unless serving HTTPS.
+	certs *certReloader
+
+	// API requests must present a verified client certificate.
+	requireClientCert bool
+
+	// nil when the audit log is not configured.
+	audit *audit.Logger
+
+	// nil when saved searches are not configured.
+	saved *saved.Store
+
+	srv *http.Server
+
 	mux *http.ServeMux
 	lck sync.RWMutex
+
+	// The searchers being served and the repos that failed to index, these
+	// are set along with mux.
+	idx    map[string]*searcher.Searcher
+	failed map[string]error
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == s.cfg.HealthCheckURI {
+	base := s.cfg.BasePath
+	// The liveness check always passes while the process is up.
+	if r.URL.Path == base+s.cfg.HealthCheckURI {
 		fmt.Fprintln(w, "👍")
 		return
 	}
 
+	if r.URL.Path == base+s.cfg.ReadinessURI {
+		s.serveReadiness(w, r)
+		return
+	}
+
+	// Relative urls in the UI only work from inside the base path.
+	if base != "" && r.URL.Path == base {
+		http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	if s.requireClientCert && strings.HasPrefix(r.URL.Path, base+"/api/") &&
+		(r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		http.Error(w, "A client certificate is required.", http.StatusForbidden)
+		return
+	}
+
+	if s.auth != nil {
+		if strings.HasPrefix(r.URL.Path, base+auth.LoginPrefix) {
+			s.auth.ServeLogin(w, r)
+			return
+		}
+
+		id, err := s.auth.Authenticate(r)
+		if err != nil {
+			s.auth.Unauthorized(w, r, err)
+			return
+		}
+		r = r.WithContext(auth.WithIdentity(r.Context(), id))
+	}
+
 	s.lck.RLock()
 	defer s.lck.RUnlock()
 	if m := s.mux; m != nil {
@@ -50,34 +111,118 @@ func (s *Server) serveWith(m *http.ServeMux) {
 // Start creates a new server that will immediately start handling HTTP traffic.
 // The HTTP server will return 200 on the health check, but a 503 on every other
 // request until ServeWithIndex is called to begin serving search traffic with
-// the given searchers.
-func Start(cfg *config.Config, addr string, dev bool) *Server {
+// the given searchers. If authentication is configured, every request other
+// than the health check must be authenticated. If TLS is configured, HTTPS
+// (and HTTP/2) is served instead of HTTP.
+func Start(cfg *config.Config, addr string, dev bool) (*Server, error) {
+	a, err := auth.New(cfg.Auth, cfg.BasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	al, err := audit.New(cfg.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+
+	ss, err := saved.Open(cfg.SavedSearches, cfg.DbPath)
+	if err != nil {
+		return nil, err
+	}
+
 	ch := make(chan error)
 
+	srv := &http.Server{
+		Addr: addr,
+	}
+
 	s := &Server{
-		cfg: cfg,
-		dev: dev,
-		ch:  ch,
+		cfg:   cfg,
+		dev:   dev,
+		ch:    ch,
+		auth:  a,
+		audit: al,
+		saved: ss,
+		srv:   srv,
+	}
+	srv.Handler = s
+
+	if cfg.TLS != nil {
+		srv.TLSConfig, s.certs, err = newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.requireClientCert = cfg.TLS.ClientCAFile != ""
+
+		go s.certs.watch()
 	}
 
 	go func() {
-		ch <- http.ListenAndServe(addr, s)
+		if s.certs != nil {
+			ch <- srv.ListenAndServeTLS("", "")
+		} else {
+			ch <- srv.ListenAndServe()
+		}
 	}()
 
-	return s
+	return s, nil
+}
+
+// ReloadCertificates loads the TLS certificate and key from disk again. New
+// connections use the new certificate, open connections are not affected.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return nil
+	}
+	return s.certs.reload()
+}
+
+// Shutdown stops accepting connections and waits for the requests that are
+// in progress to finish, or for the context to be done, along with the
+// saved searches that are running. ServeWithIndex returns
+// http.ErrServerClosed once Shutdown is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	s.saved.Close()
+	if e := s.audit.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
 // ServeWithIndex allow the server to start offering the search UI and the
-// search APIs operating on the given indexes.
-func (s *Server) ServeWithIndex(idx map[string]*searcher.Searcher) error {
-	h, err := ui.Content(s.dev, s.cfg)
+// search APIs operating on the given indexes. The repos that failed to
+// index are reported by the readiness check.
+func (s *Server) ServeWithIndex(idx map[string]*searcher.Searcher, failed map[string]error) error {
+	peers := federation.New(s.cfg.Peers)
+
+	// The UI shows the repos of peers along with the ones of our own that
+	// the caller is allowed to see.
+	repos := func(r *http.Request) map[string]*config.Repo {
+		res := peers.Repos()
+		for name, repo := range ui.ConfigRepos(s.cfg, r) {
+			res[name] = repo
+		}
+		return res
+	}
+
+	h, err := ui.Content(s.dev, s.cfg, repos)
 	if err != nil {
 		return err
 	}
 
 	m := http.NewServeMux()
-	m.Handle("/", h)
-	api.Setup(m, idx, s.cfg.ResultLimit)
+	m.Handle(s.cfg.BasePath+"/", h)
+	api.Setup(m, idx, peers, s.audit, s.saved, s.cfg.Search, s.cfg.BasePath, s.cfg.ResultLimit)
+
+	for name, srch := range idx {
+		s.saved.Watch(name, srch.Repo, srch)
+	}
+
+	s.lck.Lock()
+	s.idx = idx
+	s.failed = failed
+	s.lck.Unlock()
 
 	s.serveWith(m)
 
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hound-search/hound/auth"
+	"github.com/hound-search/hound/config"
+	"github.com/hound-search/hound/searcher"
+)
+
+// Create a server that is serving the UI and API for no repos.
+func newReadyServer(t *testing.T, cfg *config.Config) *Server {
+	s := &Server{
+		cfg: cfg,
+		ch:  make(chan error),
+	}
+
+	go s.ServeWithIndex(map[string]*searcher.Searcher{}, nil) //nolint
+
+	for i := 0; i < 100; i++ {
+		s.lck.RLock()
+		ready := s.mux != nil
+		s.lck.RUnlock()
+		if ready {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not become ready")
+	return nil
+}
+
+func TestBasePath(t *testing.T) {
+	s := newReadyServer(t, &config.Config{
+		Title:          "Hound",
+		HealthCheckURI: "/healthz",
+		ReadinessURI:   "/readyz",
+		BasePath:       "/hound",
+	})
+
+	tests := []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/hound/healthz", http.StatusOK, ""},
+		{"/hound/readyz", http.StatusOK, `"Ready":true`},
+		{"/hound", http.StatusMovedPermanently, ""},
+		{"/hound/", http.StatusOK, "/hound/open_search.xml"},
+		{"/hound/open_search.xml", http.StatusOK, "/hound/?q={searchTerms}"},
+		{"/hound/css/hound.css", http.StatusOK, ""},
+		{"/hound/api/v1/repos", http.StatusOK, "{}"},
+		{"/api/v1/repos", http.StatusNotFound, ""},
+		{"/", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.path, test.status, w.Code)
+			continue
+		}
+
+		body, _ := io.ReadAll(w.Body)
+		if !strings.Contains(string(body), test.contains) {
+			t.Errorf("%s: expected body to contain %q, got %s", test.path, test.contains, body)
+		}
+	}
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	addr := freeAddr(t)
+	s, err := Start(&config.Config{HealthCheckURI: "/healthz"}, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, finished := make(chan struct{}), make(chan struct{})
+	m := http.NewServeMux()
+	m.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done")) //nolint
+		close(finished)
+	})
+	s.serveWith(m)
+
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan *result, 1)
+	go func() {
+		var res *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if res, err = http.Get("http://" + addr + "/slow"); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			resCh <- &result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		resCh <- &result{string(b), err}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request finished before Shutdown returned.
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Shutdown returned before the in-flight request finished")
+	}
+
+	if r := <-resCh; r.err != nil || r.body != "done" {
+		t.Fatalf("expected the in-flight request to succeed, got %q %v", r.body, r.err)
+	}
+
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Fatal("expected new connections to be refused")
+	}
+
+	if err := <-s.ch; err != http.ErrServerClosed {
+		t.Fatalf("expected the server to be closed, got %v", err)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	cfg := &config.Config{
+		HealthCheckURI: "/healthz",
+		ReadinessURI:   "/readyz",
+	}
+
+	check := func(s *Server, path string, status int) *readiness {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, w.Code)
+		}
+
+		var res readiness
+		if path == cfg.ReadinessURI {
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &res
+	}
+
+	// Alive, but not ready until the indexes are served.
+	s := &Server{cfg: cfg}
+	check(s, "/healthz", http.StatusOK)
+	if res := check(s, "/readyz", http.StatusServiceUnavailable); res.Ready {
+		t.Fatal("expected not to be ready")
+	}
+
+	s.idx = map[string]*searcher.Searcher{}
+	s.failed = map[string]error{"broken": errors.New("clone failed")}
+	s.serveWith(http.NewServeMux())
+
+	// Unhealthy repos are counted, but don't fail the check by default.
+	res := check(s, "/readyz", http.StatusOK)
+	if !res.Ready || res.Repos != 1 || res.Unhealthy != 1 {
+		t.Fatalf("unexpected readiness: %+v", res)
+	}
+
+	one, none := 1, 0
+	cfg.Readiness = &config.ReadinessConfig{MaxUnhealthyRepos: &one}
+	check(s, "/readyz", http.StatusOK)
+
+	cfg.Readiness.MaxUnhealthyRepos = &none
+	if res := check(s, "/readyz", http.StatusServiceUnavailable); res.Ready || res.Unhealthy != 1 {
+		t.Fatalf("unexpected readiness: %+v", res)
+	}
+
+	// Repos are only listed for callers who could see them in the API.
+	cfg.Repos = map[string]*config.Repo{"broken": {AllowedUsers: []string{"alice"}}}
+	if res := check(s, "/readyz", http.StatusServiceUnavailable); len(res.UnhealthyRepos) != 0 {
+		t.Fatalf("expected no restricted repos, got %v", res.UnhealthyRepos)
+	}
+
+	cfg.Repos["broken"].AllowedUsers = nil
+	res = check(s, "/readyz", http.StatusServiceUnavailable)
+	if !strings.Contains(res.UnhealthyRepos["broken"], "clone failed") {
+		t.Fatalf("expected the broken repo to be listed, got %v", res.UnhealthyRepos)
+	}
+
+	// With authentication, anonymous callers only get the counts.
+	a, err := auth.New(&config.AuthConfig{
+		Tokens: []*config.AuthToken{{Token: "s3cret", User: "ci"}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = a
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if body := w.Body.String(); strings.Contains(body, "broken") || strings.Contains(body, "clone failed") {
+		t.Fatalf("expected no repo details, got %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/readyz", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	s.ServeHTTP(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "clone failed") {
+		t.Fatalf("expected the repo details, got %s", body)
+	}
+}